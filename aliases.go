@@ -0,0 +1,78 @@
+package main
+
+import (
+	"go/ast"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// majorVersion matches a major version suffix element like v2, which isn't the name a
+// package is conventionally imported by.
+var majorVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// returns the name the import path path suggests to a reader and to tools like goimports:
+// its last element, skipping a major version suffix
+func pathName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if majorVersion.MatchString(name) && len(elems) > 1 {
+		name = elems[len(elems)-2]
+	}
+	return name
+}
+
+// returns the name of the package at the import path path, if it can be built
+func packageName(path string) (string, bool) {
+	pkg, err := buildPackage(path)
+	if err != nil || pkg.Name == "" {
+		return "", false
+	}
+	return pkg.Name, true
+}
+
+// tidies the aliases of the imports of f that were rewritten, which origs maps to their
+// original import paths. An import whose new path no
+// longer ends in its package name gets that name as an explicit alias, so that readers
+// and tools can still tell what it is referred to by, and an alias merely repeating the
+// name the new path ends in is removed. The name code refers to a package by stays the
+// same either way, so neither can break the file. Imports sharing a name, which no
+// rewrite can cause, are warned about.
+func normalizeAliases(file string, f *ast.File, origs map[*ast.ImportSpec]string) {
+	seen := make(map[string]string) // import names to the import path using them
+	for _, s := range f.Imports {
+		path, err := strconv.Unquote(s.Path.Value)
+		if err != nil {
+			continue
+		}
+		orig, rewritten := origs[s]
+		if !rewritten {
+			orig = path
+		}
+		name, ok := packageName(orig)
+		if !ok {
+			// without the package's name, an alias can't be told to be redundant
+			continue
+		}
+
+		if rewritten && (s.Name == nil || s.Name.Name == name) {
+			explicit := pathName(path) != name
+			if explicit && s.Name == nil {
+				s.Name = &ast.Ident{NamePos: s.Path.Pos(), Name: name}
+			} else if !explicit && s.Name != nil {
+				s.Name = nil
+			}
+		}
+
+		if s.Name != nil {
+			name = s.Name.Name
+		}
+		if name == "_" || name == "." {
+			continue
+		}
+		if other, ok := seen[name]; ok {
+			infof("Warning: %s imports both %s and %s as %s", file, other, path, name)
+		}
+		seen[name] = path
+	}
+}
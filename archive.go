@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveFS collects the vendorized files under root in a memFS, and writes them to the
+// archive named file when closed, so that rewritten imports end up in the archived content.
+// Everything outside of root, like package sources and the root package's own files, goes
+// to the operating system's file system.
+type archiveFS struct {
+	mem  *memFS
+	file string
+	root string
+}
+
+// returns an archiveFS for the files under root, checking that file names a supported
+// archive format
+func newArchiveFS(file, root string) (*archiveFS, error) {
+	if archiveFormat(file) == "" {
+		return nil, fmt.Errorf("Unsupported archive %q: expected .tar, .tar.gz, .tgz or .zip", file)
+	}
+	a := &archiveFS{mem: newMemFS(), file: file, root: root}
+	return a, a.mem.MkdirAll(root, 0770)
+}
+
+// returns the archive format implied by the extension of file
+func archiveFormat(file string) string {
+	switch {
+	case strings.HasSuffix(file, ".tar.gz"), strings.HasSuffix(file, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(file, ".tar"):
+		return "tar"
+	case strings.HasSuffix(file, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+// returns the file system holding path
+func (a *archiveFS) fs(path string) FileSystem {
+	if _, ok := a.rel(path); ok {
+		return a.mem
+	}
+	return osFS{}
+}
+
+// returns the slash separated name of path within the archive, if it is under root
+func (a *archiveFS) rel(path string) (string, bool) {
+	rel, err := filepath.Rel(a.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (a *archiveFS) Open(name string) (File, error) { return a.fs(name).Open(name) }
+
+func (a *archiveFS) Create(name string, perm os.FileMode) (File, error) {
+	return a.fs(name).Create(name, perm)
+}
+
+// TempFile always creates temp files on the operating system's file system, in the
+// default temp dir if dir is in the archive.
+func (a *archiveFS) TempFile(dir, pattern string) (File, error) {
+	if _, ok := a.rel(dir); ok {
+		dir = ""
+	}
+	return osFS{}.TempFile(dir, pattern)
+}
+
+func (a *archiveFS) Stat(name string) (os.FileInfo, error) { return a.fs(name).Stat(name) }
+
+func (a *archiveFS) MkdirAll(path string, perm os.FileMode) error {
+	return a.fs(path).MkdirAll(path, perm)
+}
+
+func (a *archiveFS) Walk(root string, fn filepath.WalkFunc) error {
+	return a.fs(root).Walk(root, fn)
+}
+
+func (a *archiveFS) Symlink(oldname, newname string) error {
+	return a.fs(newname).Symlink(oldname, newname)
+}
+
+func (a *archiveFS) Link(oldname, newname string) error {
+	return a.fs(newname).Link(oldname, newname)
+}
+
+// Rename moves temp files, which always live on the operating system's file system,
+// into the archive when newpath is under root.
+func (a *archiveFS) Rename(oldpath, newpath string) error {
+	if _, ok := a.rel(newpath); !ok {
+		return os.Rename(oldpath, newpath)
+	}
+	in, err := os.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(oldpath)
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := a.mem.Create(newpath, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func (a *archiveFS) Remove(name string) error { return a.fs(name).Remove(name) }
+
+func (a *archiveFS) Chtimes(name string, mtime time.Time) error {
+	return a.fs(name).Chtimes(name, mtime)
+}
+
+// Close writes the files collected under root to the archive file, sorted by name.
+func (a *archiveFS) Close() error {
+	var paths []string
+	err := a.mem.Walk(a.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != a.root {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	f, err := os.Create(a.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch archiveFormat(a.file) {
+	case "zip":
+		err = a.writeZip(f, paths)
+	case "tar.gz":
+		gw := gzip.NewWriter(f)
+		if err = a.writeTar(gw, paths); err == nil {
+			err = gw.Close()
+		}
+	default:
+		err = a.writeTar(f, paths)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// returns the archive name, file info and content of the archived file at path
+func (a *archiveFS) entry(path string) (string, os.FileInfo, []byte, error) {
+	name, _ := a.rel(path)
+	info, err := a.mem.Stat(path)
+	if err != nil || info.IsDir() {
+		return name + "/", info, nil, err
+	}
+	f, err := a.mem.Open(path)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	return name, info, data, err
+}
+
+func (a *archiveFS) writeTar(w io.Writer, paths []string) error {
+	tw := tar.NewWriter(w)
+	for _, path := range paths {
+		name, info, data, err := a.entry(path)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Mode: int64(info.Mode().Perm()), ModTime: archiveModTime(info), Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if info.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (a *archiveFS) writeZip(w io.Writer, paths []string) error {
+	zw := zip.NewWriter(w)
+	for _, path := range paths {
+		name, info, data, err := a.entry(path)
+		if err != nil {
+			return err
+		}
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: archiveModTime(info)}
+		hdr.SetMode(info.Mode())
+		if info.IsDir() {
+			hdr.Method = zip.Store
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
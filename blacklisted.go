@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// userBlacklist are the prefixes given with -b, without the package and the destination
+// that are always blacklisted.
+var userBlacklist []string
+
+// blacklistedImports maps the blacklisted packages imported by vendorized packages to the
+// import paths of the packages importing them.
+var blacklistedImports = make(map[string][]string)
+
+// returns the -b prefix path is blacklisted by, if any
+func blacklistedBy(path string) (string, bool) {
+	for _, prefix := range userBlacklist {
+		if hasPackagePrefix(path, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// records the imports of the vendorized package at path that are blacklisted, so that
+// they can be reported: they are neither copied nor rewritten, so the copy of path still
+// imports them from outside of the destination
+func recordBlacklistedImports(path string, imports []string) {
+	mu.Lock()
+	_, copied := rewrites[path]
+	mu.Unlock()
+	if !copied {
+		return
+	}
+	for _, imp := range imports {
+		if prefix, ok := blacklistedBy(imp); ok {
+			verbosef("%s imports %s, which is blacklisted by -b %s", path, imp, prefix)
+			blacklistedImports[imp] = append(blacklistedImports[imp], path)
+		}
+	}
+}
+
+// warns about the blacklisted packages vendorized packages import, or with
+// -fail-on-blacklisted-transitive fails
+func reportBlacklistedImports() {
+	if len(blacklistedImports) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(blacklistedImports))
+	for path := range blacklistedImports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	lines := make([]string, len(paths))
+	for i, path := range paths {
+		importers := blacklistedImports[path]
+		sort.Strings(importers)
+		lines[i] = "  " + path + ", imported by " + strings.Join(importers, ", ")
+	}
+	if failOnBlacklisted {
+		fatalf("%d blacklisted packages are imported by vendorized packages, so the destination is incomplete:\n%s",
+			len(paths), strings.Join(lines, "\n"))
+	}
+	infof("Warning: %d blacklisted packages are imported by vendorized packages, which import them from outside of the destination:\n%s",
+		len(paths), strings.Join(lines, "\n"))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// chargedFiles and chargedBytes count the files copied over the whole run, for -budget-files
+// and -budget-bytes. They are updated atomically as files are copied, rather than summed
+// from the results, so that a budget stops the packages in flight too.
+var chargedFiles, chargedBytes int64
+
+// budgetErr is the budget exceeded, once one is. Guarded by mu.
+var budgetErr error
+
+// counts a file of size bytes about to be copied against -budget-files and -budget-bytes,
+// returning an error if that exceeds either. Once a budget is exceeded every later file
+// fails too, so that the packages in flight stop copying.
+func chargeBudget(size int64) error {
+	if budgetFiles <= 0 && budgetBytes <= 0 {
+		return nil
+	}
+	if err := budgetExceeded(); err != nil {
+		return err
+	}
+	files := atomic.AddInt64(&chargedFiles, 1)
+	bytes := atomic.AddInt64(&chargedBytes, size)
+	var err error
+	switch {
+	case budgetFiles > 0 && files > budgetFiles:
+		err = fmt.Errorf("Exceeded -budget-files %d: copying more than %d files", budgetFiles, budgetFiles)
+	case budgetBytes > 0 && bytes > int64(budgetBytes):
+		err = fmt.Errorf("Exceeded -budget-bytes %s: copying %s", formatSize(int64(budgetBytes)), formatSize(bytes))
+	default:
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if budgetErr == nil {
+		budgetErr = err
+	}
+	return budgetErr
+}
+
+// returns the budget that was exceeded, or nil while none is
+func budgetExceeded() error {
+	mu.Lock()
+	defer mu.Unlock()
+	return budgetErr
+}
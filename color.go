@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+)
+
+// ANSI escape sequences for the colors package statuses are logged in.
+const (
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+	colorReset  = "\x1b[0m"
+)
+
+// useColor is whether statuses logged to stderr are colored, decided once by setupColor.
+var useColor bool
+
+// turns on colored statuses when stderr is a terminal, unless -no-color is given or the
+// NO_COLOR environment variable is set to anything at all (see https://no-color.org)
+func setupColor() {
+	if noColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return
+	}
+	info, err := os.Stderr.Stat()
+	useColor = err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// returns s wrapped in color when colored output is on
+func colorize(color, s string) string {
+	if !useColor {
+		return s
+	}
+	return color + s + colorReset
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path"
+	"sort"
+)
+
+// compares the tree of files under root with the one under other, taken to be the older
+// of the two. The packages added, removed or changed are written to stdout, one per line
+// prefixed with +, - or ~, and the files that differ are logged with -v.
+func compareTrees(root, other string) error {
+	if _, err := fsys.Stat(other); err != nil {
+		return err
+	}
+	ours, err := treeSums(root, "")
+	if err != nil {
+		return err
+	}
+	theirs, err := treeSums(other, "")
+	if err != nil {
+		return err
+	}
+
+	// a package is the set of files directly in a directory
+	oursPkgs := make(map[string]bool)
+	for file := range ours {
+		oursPkgs[path.Dir(file)] = true
+	}
+	theirsPkgs := make(map[string]bool)
+	for file := range theirs {
+		theirsPkgs[path.Dir(file)] = true
+	}
+
+	var files []string
+	changedPkgs := make(map[string]bool)
+	for file, sum := range ours {
+		switch theirSum, ok := theirs[file]; {
+		case !ok:
+			files = append(files, "added   "+file)
+		case theirSum != sum:
+			files = append(files, "changed "+file)
+		default:
+			continue
+		}
+		changedPkgs[path.Dir(file)] = true
+	}
+	for file := range theirs {
+		if _, ok := ours[file]; !ok {
+			files = append(files, "removed "+file)
+			changedPkgs[path.Dir(file)] = true
+		}
+	}
+
+	var added, removed, changed []string
+	for pkg := range changedPkgs {
+		switch {
+		case !theirsPkgs[pkg]:
+			added = append(added, pkg)
+		case !oursPkgs[pkg]:
+			removed = append(removed, pkg)
+		default:
+			changed = append(changed, pkg)
+		}
+	}
+	for _, list := range [][]string{added, removed, changed, files} {
+		sort.Strings(list)
+	}
+	for _, pkg := range added {
+		outputf("+ %s\n", pkg)
+	}
+	for _, pkg := range removed {
+		outputf("- %s\n", pkg)
+	}
+	for _, pkg := range changed {
+		outputf("~ %s\n", pkg)
+	}
+	for _, file := range files {
+		verbosef("  %s", file)
+	}
+	infof("Compared with %q: %d packages added, %d removed and %d changed, %d files in all", other, len(added), len(removed), len(changed), len(files))
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// logs the configuration the run resolved to with -v, before anything is vendorized
+func logConfig(pkgName, dest string) {
+	if !verbose || quiet {
+		return
+	}
+	var set []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "b" { // listed with the blacklist
+			set = append(set, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+	lines := []string{
+		"Configuration:",
+		fmt.Sprintf("  package:     %s", pkgName),
+		fmt.Sprintf("  destination: %s", dest),
+		fmt.Sprintf("  GOPATH:      %s (copying into %s)", goEnv("GOPATH"), gopath),
+		fmt.Sprintf("  GOROOT:      %s", goEnv("GOROOT")),
+		fmt.Sprintf("  GOOS/GOARCH: %s/%s", goEnv("GOOS"), goEnv("GOARCH")),
+		fmt.Sprintf("  blacklist:   %s (the package and the destination are always included)", strings.Join(blacklistedPrefixes, ", ")),
+		fmt.Sprintf("  flags:       %s", strings.Join(set, " ")),
+	}
+	verbosef("%s", strings.Join(lines, "\n"))
+}
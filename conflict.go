@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// The -on-conflict policies for destination files that already exist.
+const (
+	conflictSkip      = "skip"      // leave the existing file alone
+	conflictOverwrite = "overwrite" // replace the existing file
+	conflictError     = "error"     // fail if the existing file differs
+	conflictBackup    = "backup"    // rename the existing file to .bak if it differs
+)
+
+// backups are the .bak files made by the backup policy in this run, which -mirror keeps.
+// Guarded by mu.
+var backups = make(map[string]bool)
+
+// checks the -on-conflict policy, reconciling it with -f, -mirror and -only, which
+// overwrite existing files
+func checkOnConflict() error {
+	switch onConflict {
+	case "":
+		onConflict = conflictSkip
+		if forceUpdates {
+			onConflict = conflictOverwrite
+		}
+	case conflictSkip:
+		if forceUpdates {
+			return fmt.Errorf("%s can't be used with -on-conflict %s: it overwrites existing files", forcingFlag(), onConflict)
+		}
+	case conflictOverwrite, conflictError, conflictBackup:
+		forceUpdates = true
+	default:
+		return fmt.Errorf("Unknown -on-conflict policy %q: want skip, overwrite, error or backup", onConflict)
+	}
+	return nil
+}
+
+// returns the flag that made existing files be overwritten, for errors
+func forcingFlag() string {
+	switch {
+	case mirror:
+		return "-mirror"
+	case only != "":
+		return "-only"
+	}
+	return "-f"
+}
+
+// applies the error and backup policies to the existing file dest before src is
+// copied over it
+func handleConflict(dest, src string) error {
+	if onConflict != conflictError && onConflict != conflictBackup {
+		return nil
+	}
+	same, err := sameContent(dest, src)
+	if err != nil || same {
+		return err
+	}
+	if onConflict == conflictError {
+		return fmt.Errorf("%q already exists and differs from %q", dest, src)
+	}
+	infof("Backing up %q to %q", dest, dest+".bak")
+	planned("rename", dest+".bak", dest)
+	if dry {
+		return nil
+	}
+	if err := fsys.Rename(dest, dest+".bak"); err != nil {
+		return err
+	}
+	mu.Lock()
+	backups[dest+".bak"] = true
+	mu.Unlock()
+	return nil
+}
+
+// reports whether the files a and b have the same content
+func sameContent(a, b string) (bool, error) {
+	dataA, err := readFile(a)
+	if err != nil {
+		return false, err
+	}
+	dataB, err := readFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(dataA, dataB), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// The -copy-mode ways of materializing vendorized files.
+const (
+	copyModeCopy     = "copy"     // copy the content
+	copyModeMove     = "move"     // move the source file, removing it from its package
+	copyModeSymlink  = "symlink"  // link to the source file symbolically
+	copyModeHardlink = "hardlink" // link to the source file
+)
+
+// checks that -copy-mode is known and fits the other flags
+func checkCopyMode() error {
+	switch copyMode {
+	case copyModeCopy:
+	case copyModeMove:
+		if mirror {
+			return fmt.Errorf("-mirror can't be used with -copy-mode %s, since it prunes files whose sources are gone", copyMode)
+		}
+		errorf("Warning: -copy-mode %s removes the copied files from their source packages", copyMode)
+	case copyModeSymlink, copyModeHardlink:
+		if archive != "" {
+			return fmt.Errorf("-archive can't be used with -copy-mode %s", copyMode)
+		}
+	default:
+		return fmt.Errorf("Unknown -copy-mode %q: want copy, move, symlink or hardlink", copyMode)
+	}
+	return nil
+}
+
+// moves src to dest, falling back to copying and removing src when it can't be renamed,
+// like across devices
+func moveFile(dest, src string, perm os.FileMode) error {
+	err := fsys.Rename(src, dest)
+	if err == nil {
+		return nil
+	}
+	verbosef("Couldn't rename %q to %q, copying instead: %s", src, dest, err)
+	if err := copyData(dest, src, perm); err != nil {
+		return err
+	}
+	return fsys.Remove(src)
+}
+
+// replaces dest with a link to src of the kind given by -copy-mode. Hard links can't span
+// devices, so those fall back to copying.
+func linkFile(dest, src string, perm os.FileMode) error {
+	if err := fsys.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if copyMode == copyModeSymlink {
+		return fsys.Symlink(src, dest)
+	}
+	if err := fsys.Link(src, dest); err != nil {
+		verbosef("Couldn't link %q to %q, copying instead: %s", dest, src, err)
+		return copyData(dest, src, perm)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// deprecated maps the import paths of vendorized packages marked deprecated to their deprecation message.
+var deprecated = make(map[string]string)
+
+// checkDeprecated records and warns about pkg if its package doc carries a "Deprecated:" paragraph.
+func checkDeprecated(pkg *build.Package) error {
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, file := range append(append([]string(nil), pkg.GoFiles...), pkg.CgoFiles...) {
+		path := filepath.Join(pkg.Dir, file)
+		src, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		f, err := parser.ParseFile(fset, path, src, parser.PackageClauseOnly|parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	p, err := doc.NewFromFiles(fset, files, pkg.ImportPath)
+	if err != nil {
+		return err
+	}
+	msg, ok := deprecationMessage(p.Doc)
+	if !ok {
+		return nil
+	}
+
+	infof("Warning: %s is deprecated: %s", pkg.ImportPath, msg)
+	mu.Lock()
+	deprecated[pkg.ImportPath] = msg
+	mu.Unlock()
+	return nil
+}
+
+// returns the text of the "Deprecated:" paragraph in a package doc, if there is one
+func deprecationMessage(text string) (string, bool) {
+	for _, para := range strings.Split(text, "\n\n") {
+		para = strings.TrimSpace(para)
+		if strings.HasPrefix(para, "Deprecated:") {
+			msg := strings.TrimSpace(strings.TrimPrefix(para, "Deprecated:"))
+			return strings.Join(strings.Fields(msg), " "), true
+		}
+	}
+	return "", false
+}
+
+// logs the deprecated packages found during the run
+func reportDeprecated() {
+	if len(deprecated) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(deprecated))
+	for path := range deprecated {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	infof("Vendorized %d deprecated packages:", len(paths))
+	for _, path := range paths {
+		infof("  %s: %s", path, deprecated[path])
+	}
+}
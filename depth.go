@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+)
+
+// parents maps the import path of every package visited to the import path of the
+// package it was first reached from, or "" for the packages vendorization started at.
+var parents = make(map[string]string)
+
+// records that path was reached from parent, unless it was reached before. Roots are
+// recorded with an empty parent before anything else, so the chains can't loop.
+func recordParent(path, parent string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := parents[path]; !ok {
+		parents[path] = parent
+	}
+}
+
+// returns the chain of packages from a root down to path, following the first import
+// each package was reached through
+func chainTo(path string) []string {
+	chain := []string{path}
+	for parent := parents[path]; parent != ""; parent = parents[parent] {
+		chain = append(chain, parent)
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// logs the deepest dependency chain with -v, and warns about it when it is more than
+// maxDepthWarn imports deep
+func reportDepth() {
+	var deepest []string
+	for path := range parents {
+		chain := chainTo(path)
+		if len(chain) > len(deepest) || (len(chain) == len(deepest) && path < deepest[len(deepest)-1]) {
+			deepest = chain
+		}
+	}
+	if len(deepest) < 2 {
+		return
+	}
+	depth := len(deepest) - 1
+	if maxDepthWarn > 0 && depth > maxDepthWarn {
+		infof("Warning: deepest dependency chain is %d levels, over the -max-depth-warn limit of %d: %s", depth, maxDepthWarn, strings.Join(deepest, " -> "))
+		return
+	}
+	verbosef("Deepest dependency chain is %d levels: %s", depth, strings.Join(deepest, " -> "))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// destMap maps the import paths listed in the -dest-map file to the import path each
+// is vendorized at, in place of the one computed from the destination.
+var destMap = make(map[string]string)
+
+// reads the -dest-map file at path, made of importpath=destpath lines. Blank lines and
+// lines starting with # are skipped. A package can only be listed once, and no two
+// packages can be mapped to the same place.
+func loadDestMap(path string) error {
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	mappedFrom := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, "=")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: expected importpath=destpath", path, line)
+		}
+		from, to := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+		for _, p := range []string{from, to} {
+			if err := validImportPath(p); err != nil {
+				return fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+		}
+		if from == to {
+			return fmt.Errorf("%s:%d: %s is mapped to itself", path, line, from)
+		}
+		if _, ok := destMap[from]; ok {
+			return fmt.Errorf("%s:%d: %s is mapped more than once", path, line, from)
+		}
+		if other, ok := mappedFrom[to]; ok {
+			return fmt.Errorf("%s:%d: %s and %s are both mapped to %s", path, line, other, from, to)
+		}
+		destMap[from] = to
+		mappedFrom[to] = from
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// deterministicTime is the modification time of every archive entry with -deterministic.
+// Zip can't record times before 1980.
+var deterministicTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// returns the modification time to archive the file described by info with
+func archiveModTime(info os.FileInfo) time.Time {
+	if deterministic {
+		return deterministicTime
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"sort"
+)
+
+// maxDupesReported is the number of duplicated files listed by reportDupes.
+const maxDupesReported = 10
+
+// dupeSet is a set of copied files sharing the same content.
+type dupeSet struct {
+	sum   string
+	size  int64
+	paths []string
+}
+
+// wasted returns the bytes taken up by every copy but the first.
+func (d *dupeSet) wasted() int64 {
+	return d.size * int64(len(d.paths)-1)
+}
+
+// contentIndex maps content hashes of copied files to the files that share them.
+var contentIndex = make(map[string]*dupeSet)
+
+// records the hash of a copied file in the content index
+func recordContent(sum []byte, size int64, path string) {
+	key := hex.EncodeToString(sum)
+	mu.Lock()
+	defer mu.Unlock()
+	d, ok := contentIndex[key]
+	if !ok {
+		d = &dupeSet{sum: key, size: size}
+		contentIndex[key] = d
+	}
+	d.paths = append(d.paths, path)
+}
+
+// writes the most duplicated files and the total duplicated bytes to stdout
+func reportDupes(root string) {
+	var dupes []*dupeSet
+	var total int64
+	for _, d := range contentIndex {
+		if len(d.paths) > 1 {
+			dupes = append(dupes, d)
+			total += d.wasted()
+		}
+	}
+	sort.Slice(dupes, func(i, j int) bool {
+		if dupes[i].wasted() != dupes[j].wasted() {
+			return dupes[i].wasted() > dupes[j].wasted()
+		}
+		return dupes[i].sum < dupes[j].sum
+	})
+
+	outputf("%d bytes duplicated across %d sets of identical files\n", total, len(dupes))
+	if len(dupes) > maxDupesReported {
+		dupes = dupes[:maxDupesReported]
+	}
+	for _, d := range dupes {
+		sort.Strings(d.paths)
+		outputf("%s %d bytes x %d copies (%d bytes wasted)\n", d.sum[:12], d.size, len(d.paths), d.wasted())
+		for _, path := range d.paths {
+			if rel, err := filepath.Rel(root, path); err == nil {
+				path = rel
+			}
+			outputf("\t%s\n", path)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// sniffLen is how much of a file is looked at to tell text from binary.
+const sniffLen = 8000
+
+// checks that -normalize-eol names a known line ending
+func checkNormalizeEOL() error {
+	switch normalizeEOL {
+	case "":
+		return nil
+	case "lf", "crlf":
+		if copyMode != copyModeCopy {
+			return fmt.Errorf("-normalize-eol can't be used with -copy-mode %s", copyMode)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown -normalize-eol %q: want lf or crlf", normalizeEOL)
+}
+
+// returns r with its line endings normalized per -normalize-eol, unless its content
+// looks binary, in which case it is passed through untouched
+func normalizeLineEndings(r io.Reader) io.Reader {
+	if normalizeEOL == "" {
+		return r
+	}
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	if !isText(head, len(head) == sniffLen) {
+		return br
+	}
+	return &eolReader{r: br, crlf: normalizeEOL == "crlf"}
+}
+
+// reports whether the start of a file looks like text: no NUL bytes and valid UTF-8.
+// If the start was cut off, a rune may be split at its end.
+func isText(head []byte, cut bool) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	if cut {
+		for i := 1; i < utf8.UTFMax && i <= len(head); i++ {
+			if utf8.RuneStart(head[len(head)-i]) {
+				if !utf8.FullRune(head[len(head)-i:]) {
+					head = head[:len(head)-i]
+				}
+				break
+			}
+		}
+	}
+	return utf8.Valid(head)
+}
+
+// eolReader converts the line endings of text read from r to LF, or to CRLF if crlf is
+// set. With LF, any run of CRs ending a line is dropped; other CRs are left alone.
+type eolReader struct {
+	r       *bufio.Reader
+	crlf    bool
+	prev    byte   // last byte read from r
+	crs     int    // CRs read but not yet returned, in LF mode
+	pending []byte // converted bytes that didn't fit into p
+}
+
+func (e *eolReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(e.pending) > 0 {
+			c := copy(p[n:], e.pending)
+			n += c
+			e.pending = e.pending[c:]
+			continue
+		}
+		b, err := e.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && e.crs > 0 {
+				e.pending = bytes.Repeat([]byte{'\r'}, e.crs)
+				e.crs = 0
+				continue
+			}
+			return n, err
+		}
+		prev := e.prev
+		e.prev = b
+		switch {
+		case !e.crlf && b == '\r':
+			e.crs++
+		case !e.crlf && b == '\n':
+			e.crs = 0
+			e.pending = append(e.pending, b)
+		case !e.crlf && e.crs > 0:
+			e.pending = append(bytes.Repeat([]byte{'\r'}, e.crs), b)
+			e.crs = 0
+		case e.crlf && b == '\n' && prev != '\r':
+			e.pending = append(e.pending, '\r', '\n')
+		default:
+			p[n] = b
+			n++
+		}
+	}
+	return n, nil
+}
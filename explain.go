@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// explanations maps the import paths of the packages encountered to what became of them,
+// with -explain.
+var explanations = make(map[string]string)
+
+// records what became of the package of r
+func recordExplanation(r vendorizeResult) {
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case r.status == statusFailed:
+		explanations[r.path] = "failed: " + r.err.Error()
+	case r.skip == skipVisited:
+		explanations[r.path] = "skipped: already visited"
+	case r.status == statusSkipped:
+		explanations[r.path] = "skipped (" + string(r.skip) + "): " + r.why
+	default:
+		explanations[r.path] = "copied to " + rewrites[r.path]
+	}
+}
+
+// records that the standard library package at path was imported, and so left alone
+func recordGoroot(path string) {
+	mu.Lock()
+	defer mu.Unlock()
+	explanations[path] = "skipped: in GOROOT"
+}
+
+// prints what became of every package encountered, sorted by import path
+func printExplanations() {
+	paths := make([]string, 0, len(explanations))
+	for path := range explanations {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, path := range paths {
+		fmt.Fprintf(w, "%s\t%s\n", path, explanations[path])
+	}
+	w.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checks that -min-fan-in and -max-fan-in describe a range with something in it
+func checkFanIn() error {
+	if minFanIn < 0 || maxFanIn < 0 {
+		return fmt.Errorf("-min-fan-in and -max-fan-in can't be negative")
+	}
+	if maxFanIn > 0 && minFanIn > maxFanIn {
+		return fmt.Errorf("-min-fan-in %d is more than -max-fan-in %d", minFanIn, maxFanIn)
+	}
+	return nil
+}
+
+// returns the number of packages in the recorded imports importing each package, with or
+// without tests
+func fanIn() map[string]int {
+	counts := make(map[string]int)
+	for e := range graphEdges {
+		if e.from != e.to {
+			counts[e.to]++
+		}
+	}
+	return counts
+}
+
+// returns the packages vendorized in this run whose fan-in is within -min-fan-in and
+// -max-fan-in, for pruneUnreachable to keep
+func withinFanIn() map[string]bool {
+	counts := fanIn()
+	keep := make(map[string]bool)
+	for path := range rewrites {
+		n := counts[path]
+		if n >= minFanIn && (maxFanIn == 0 || n <= maxFanIn) {
+			keep[path] = true
+		} else {
+			verbosef("%s is imported by %d packages, not %s", path, n, fanInRange())
+		}
+	}
+	return keep
+}
+
+// describes the -min-fan-in and -max-fan-in range, for logs
+func fanInRange() string {
+	var bounds []string
+	if minFanIn > 0 {
+		bounds = append(bounds, fmt.Sprintf("at least %d", minFanIn))
+	}
+	if maxFanIn > 0 {
+		bounds = append(bounds, fmt.Sprintf("at most %d", maxFanIn))
+	}
+	return strings.Join(bounds, " and ")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// fileModeFlag is a flag.Value holding permission bits given in octal, like 0444.
+type fileModeFlag struct {
+	mode os.FileMode
+	set  bool
+}
+
+// formats the fileModeFlag
+func (m *fileModeFlag) String() string {
+	if !m.set {
+		return ""
+	}
+	return fmt.Sprintf("%#o", m.mode)
+}
+
+func (m *fileModeFlag) Set(value string) error {
+	n, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || n > uint64(os.ModePerm) {
+		return fmt.Errorf("invalid file mode %q: expected octal permission bits, like 0644", value)
+	}
+	m.mode, m.set = os.FileMode(n), true
+	return nil
+}
+
+// checks that -file-mode is only given with -copy-mode copy: moved files keep the mode
+// of the file they were, and links share it with their source
+func checkFileMode() error {
+	if fileMode.set && copyMode != copyModeCopy {
+		return fmt.Errorf("-file-mode can't be used with -copy-mode %s", copyMode)
+	}
+	return nil
+}
+
+// returns the permissions a file copied or rewritten from a source with permissions perm
+// is written with
+func destPerm(perm os.FileMode) os.FileMode {
+	if fileMode.set {
+		return fileMode.mode
+	}
+	return perm
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+)
+
+// packageFilter reports why pkg shouldn't be vendorized, or "" if it should be.
+type packageFilter func(pkg *build.Package) string
+
+// packageFilters are consulted for every package before it is copied. A package skipped
+// by one isn't copied or rewritten, but its imports are still vendorized.
+var packageFilters []packageFilter
+
+// adds the filters asked for on the command line
+func setupPackageFilters() {
+	if skipCgo {
+		packageFilters = append(packageFilters, func(pkg *build.Package) string {
+			if len(pkg.CgoFiles) > 0 {
+				return "it uses cgo"
+			}
+			return ""
+		})
+	}
+	if skipInCache {
+		packageFilters = append(packageFilters, func(pkg *build.Package) string {
+			dir, ok := inModCache(pkg.ImportPath)
+			if !ok {
+				return ""
+			}
+			recordCached(pkg.ImportPath, dir)
+			return "it is in the module cache"
+		})
+	}
+	if len(skipNames) > 0 {
+		names := make(map[string]bool)
+		for _, name := range skipNames {
+			names[name] = true
+		}
+		packageFilters = append(packageFilters, func(pkg *build.Package) string {
+			if names[pkg.Name] {
+				return fmt.Sprintf("it is package %s", pkg.Name)
+			}
+			return ""
+		})
+	}
+}
+
+// returns why pkg is filtered out, or "" if no filter skips it
+func filtered(pkg *build.Package) string {
+	for _, filter := range packageFilters {
+		if reason := filter(pkg); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
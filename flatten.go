@@ -0,0 +1,43 @@
+package main
+
+import (
+	"go/build"
+	"strings"
+)
+
+// reports whether pkg consists of exactly one Go file and nothing else
+func isSingleFile(pkg *build.Package) bool {
+	if len(pkg.GoFiles) != 1 {
+		return false
+	}
+	for _, files := range [][]string{
+		pkg.CgoFiles, pkg.TestGoFiles, pkg.XTestGoFiles, pkg.IgnoredGoFiles,
+		pkg.CFiles, pkg.CXXFiles, pkg.MFiles, pkg.HFiles, pkg.FFiles, pkg.SFiles,
+		pkg.SwigFiles, pkg.SwigCXXFiles, pkg.SysoFiles,
+	} {
+		if len(files) > 0 {
+			return false
+		}
+	}
+
+	// copyDir copies every file in the directory, not just the ones go/build knows about
+	entries, err := readDir(pkg.Dir)
+	if err != nil {
+		return false
+	}
+	files := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files++
+		}
+	}
+	return files == 1
+}
+
+// returns the directory name a flattened package is placed in. Each package keeps its
+// own directory, named after its whole import path with the slashes replaced. Paths
+// differing only in where they have slashes and underscores, like a/b_c and a_b/c, get
+// the same name; vendoredPath then fails the second package, as for any collision.
+func flattenedName(path string) string {
+	return strings.Replace(path, "/", "_", -1)
+}
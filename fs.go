@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is an open file of a FileSystem.
+type File interface {
+	io.ReadWriteCloser
+	Name() string
+	Chmod(mode os.FileMode) error
+}
+
+// FileSystem is the file system vendorize reads packages from and writes them to.
+type FileSystem interface {
+	Open(name string) (File, error)
+	// Create creates or truncates name with the permissions given by perm.
+	Create(name string, perm os.FileMode) (File, error)
+	// TempFile creates a new temporary file in dir, or in the default temp dir if dir is empty.
+	TempFile(dir, pattern string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Walk(root string, fn filepath.WalkFunc) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Chtimes(name string, mtime time.Time) error
+	// Symlink creates newname as a symbolic link to oldname.
+	Symlink(oldname, newname string) error
+	// Link creates newname as a hard link to oldname.
+	Link(oldname, newname string) error
+}
+
+// fsys is the file system all of vendorize's IO goes through.
+var fsys FileSystem = osFS{}
+
+// osFS is the FileSystem of the operating system.
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Create(name string, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (osFS) TempFile(dir, pattern string) (File, error) {
+	return ioutil.TempFile(dir, pattern)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// MkdirAll tolerates the directories being made concurrently, as packages in the same
+// parent directory are copied by different workers. os.MkdirAll already allows for a parent
+// appearing as it runs, but some file systems, like NFS, report that as errors other than
+// os.IsExist, so failing to make a directory that then turns out to exist isn't an error.
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	err := os.MkdirAll(path, perm)
+	for i := 0; err != nil && i < mkdirRetries; i++ {
+		if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+			return nil
+		}
+		// a parent may have been made, by another worker, just too late
+		err = os.MkdirAll(path, perm)
+	}
+	return err
+}
+
+// mkdirRetries is how many more times osFS.MkdirAll tries to make a directory that failed
+// to be made, before giving up.
+const mkdirRetries = 2
+
+func (osFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(name, time.Now(), mtime)
+}
+
+func (osFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// memFS is a FileSystem held in memory. Paths are cleaned before use, and directories
+// must exist before files are created in them, as on a real file system.
+type memFS struct {
+	mu      sync.Mutex
+	entries map[string]*memEntry
+	temps   int
+}
+
+// memEntry is a file or directory of a memFS.
+type memEntry struct {
+	data  []byte
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// returns an empty memFS holding only the root directory
+func newMemFS() *memFS {
+	root := string(filepath.Separator)
+	return &memFS{entries: map[string]*memEntry{root: {mode: os.ModeDir | 0770, mtime: time.Now()}}}
+}
+
+func (m *memFS) notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[filepath.Clean(name)]
+	if !ok {
+		return nil, m.notExist("open", name)
+	}
+	return &memFile{fs: m, name: filepath.Clean(name), mode: e.mode, r: bytes.NewReader(e.data)}, nil
+}
+
+func (m *memFS) Create(name string, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if parent, ok := m.entries[filepath.Dir(name)]; !ok || !parent.mode.IsDir() {
+		return nil, m.notExist("open", name)
+	}
+	mode := perm
+	if e, ok := m.entries[name]; ok {
+		mode = e.mode
+	}
+	m.entries[name] = &memEntry{mode: mode, mtime: time.Now()}
+	return &memFile{fs: m, name: name, mode: mode, w: true}, nil
+}
+
+func (m *memFS) TempFile(dir, pattern string) (File, error) {
+	if dir == "" {
+		dir = os.TempDir()
+		if err := m.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	m.mu.Lock()
+	m.temps++
+	name := filepath.Join(dir, fmt.Sprintf("%s%d", pattern, m.temps))
+	m.mu.Unlock()
+	return m.Create(name, 0600)
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[filepath.Clean(name)]
+	if !ok {
+		return nil, m.notExist("stat", name)
+	}
+	return memFileInfo{name: filepath.Base(name), entry: *e}, nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if e, ok := m.entries[dir]; ok {
+			if !e.mode.IsDir() {
+				return fmt.Errorf("mkdir %s: not a directory", dir)
+			}
+		} else {
+			m.entries[dir] = &memEntry{mode: os.ModeDir | perm, mtime: time.Now()}
+		}
+		if filepath.Dir(dir) == dir {
+			return nil
+		}
+	}
+}
+
+// Walk walks the tree rooted at root in lexical order, like filepath.Walk.
+func (m *memFS) Walk(root string, fn filepath.WalkFunc) error {
+	root = filepath.Clean(root)
+	m.mu.Lock()
+	var names []string
+	infos := make(map[string]os.FileInfo)
+	for name, e := range m.entries {
+		if name == root || strings.HasPrefix(name, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			names = append(names, name)
+			infos[name] = memFileInfo{name: filepath.Base(name), entry: *e}
+		}
+	}
+	m.mu.Unlock()
+
+	if len(names) == 0 {
+		return fn(root, nil, m.notExist("lstat", root))
+	}
+	sort.Strings(names)
+
+	var skip string
+	for _, name := range names {
+		if skip != "" && strings.HasPrefix(name, skip) {
+			continue
+		}
+		info := infos[name]
+		err := fn(name, info, nil)
+		if err == filepath.SkipDir {
+			if info.IsDir() {
+				if name == root {
+					return nil
+				}
+				skip = name + string(filepath.Separator)
+			} else {
+				skip = filepath.Dir(name) + string(filepath.Separator)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	e, ok := m.entries[oldpath]
+	if !ok {
+		return m.notExist("rename", oldpath)
+	}
+	if _, ok := m.entries[filepath.Dir(newpath)]; !ok {
+		return m.notExist("rename", newpath)
+	}
+	delete(m.entries, oldpath)
+	m.entries[newpath] = e
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	e, ok := m.entries[name]
+	if !ok {
+		return m.notExist("remove", name)
+	}
+	if e.mode.IsDir() {
+		for other := range m.entries {
+			if strings.HasPrefix(other, name+string(filepath.Separator)) {
+				return fmt.Errorf("remove %s: directory not empty", name)
+			}
+		}
+	}
+	delete(m.entries, name)
+	return nil
+}
+
+func (m *memFS) Chtimes(name string, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[filepath.Clean(name)]
+	if !ok {
+		return m.notExist("chtimes", name)
+	}
+	e.mtime = mtime
+	return nil
+}
+
+// memFS holds plain files and directories only, so links can't be created in it.
+func (m *memFS) Symlink(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errors.New("links aren't supported in memory")}
+}
+
+func (m *memFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.New("links aren't supported in memory")}
+}
+
+// memFile is an open file of a memFS. Writes are buffered and stored when the file is closed.
+type memFile struct {
+	fs   *memFS
+	name string
+	mode os.FileMode
+	r    *bytes.Reader
+	w    bool
+	buf  bytes.Buffer
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+	f.mode = mode
+	if f.w {
+		return nil
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if e, ok := f.fs.entries[f.name]; ok {
+		e.mode = mode
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, fmt.Errorf("read %s: file not open for reading", f.name)
+	}
+	return f.r.Read(p)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if !f.w {
+		return 0, fmt.Errorf("write %s: file not open for writing", f.name)
+	}
+	return f.buf.Write(p)
+}
+
+func (f *memFile) Close() error {
+	if !f.w {
+		return nil
+	}
+	f.w = false
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.entries[f.name] = &memEntry{data: f.buf.Bytes(), mode: f.mode, mtime: time.Now()}
+	return nil
+}
+
+// memFileInfo describes an entry of a memFS.
+type memFileInfo struct {
+	name  string
+	entry memEntry
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.entry.data)) }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.entry.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.entry.mtime }
+func (fi memFileInfo) IsDir() bool        { return fi.entry.mode.IsDir() }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// returns the entries directly inside dir, sorted by name
+func readDir(dir string) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		entries = append(entries, info)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// returns the contents of the file name
+func readFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writes the contents of r to name, creating it with the permissions given by perm
+func writeFile(name string, r io.Reader, perm os.FileMode) error {
+	out, err := fsys.Create(name, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// atomically replaces name with the output of write, by writing to a temp file first.
+// The temp file is created next to name, so the rename never crosses devices, unless
+// -tmpdir says otherwise. A temp file that can't be renamed is copied into place
+// instead, which isn't atomic.
+func replaceFile(name string, perm os.FileMode, write func(io.Writer) error) (err error) {
+	dir := tmpDir
+	if dir == "" {
+		dir = filepath.Dir(name)
+	}
+	f, err := fsys.TempFile(dir, ".vendorize")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			fsys.Remove(f.Name())
+		}
+	}()
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return moveFile(name, f.Name(), perm)
+}
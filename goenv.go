@@ -0,0 +1,75 @@
+package main
+
+import (
+	"go/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// goEnvVars are the settings read from `go env`, in the order it prints them.
+var goEnvVars = []string{"GOPATH", "GOROOT", "GOOS", "GOARCH", "GOMODCACHE"}
+
+var (
+	goEnvOnce   sync.Once
+	goEnvValues map[string]string
+)
+
+// goEnv returns the effective value of the go setting key, as the go tool would use it. This
+// picks up defaults such as $HOME/go for an unset GOPATH. The values are read from `go env`
+// once; if the go tool isn't available, the environment and go/build defaults are used instead.
+func goEnv(key string) string {
+	goEnvOnce.Do(func() {
+		goEnvValues = make(map[string]string)
+		out, err := exec.Command("go", append([]string{"env"}, goEnvVars...)...).Output()
+		lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+		if err != nil || len(lines) != len(goEnvVars) {
+			verbosef("Couldn't run go env, falling back to the environment: %v", err)
+			return
+		}
+		for i, key := range goEnvVars {
+			goEnvValues[key] = lines[i]
+		}
+	})
+
+	if value, ok := goEnvValues[key]; ok {
+		return value
+	}
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	switch key {
+	case "GOPATH":
+		return build.Default.GOPATH
+	case "GOROOT":
+		return build.Default.GOROOT
+	case "GOOS":
+		return build.Default.GOOS
+	case "GOARCH":
+		return build.Default.GOARCH
+	case "GOMODCACHE":
+		if entries := filepath.SplitList(goEnv("GOPATH")); len(entries) > 0 {
+			return filepath.Join(entries[0], "pkg", "mod")
+		}
+	}
+	return ""
+}
+
+// returns the GOPATH entries holding a directory for the import path path, in GOPATH
+// order, so that the first is the one go/build resolves the path in
+func gopathEntries(path string) []string {
+	var entries []string
+	for _, entry := range filepath.SplitList(goEnv("GOPATH")) {
+		if entry == "" {
+			continue
+		}
+		entry = canonicalPath(entry)
+		info, err := fsys.Stat(filepath.Join(entry, "src", filepath.FromSlash(path)))
+		if err == nil && info.IsDir() {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
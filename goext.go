@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"go/scanner"
+	"strings"
+)
+
+// checks that every -rewrite-ext is an extension other than .go
+func checkRewriteExts() error {
+	for _, ext := range rewriteExts {
+		if !strings.HasPrefix(ext, ".") || ext == "." || ext == ".go" {
+			return fmt.Errorf("Invalid -rewrite-ext %q: expected an extension other than .go, like .go.in", ext)
+		}
+	}
+	return nil
+}
+
+// reports whether the file name has a -rewrite-ext extension
+func hasRewriteExt(name string) bool {
+	for _, ext := range rewriteExts {
+		if strings.HasSuffix(name, ext) && name != ext {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the names of the files in dir with a -rewrite-ext extension, which are
+// rewritten as Go source
+func extRewriteFiles(dir string) ([]string, error) {
+	if len(rewriteExts) == 0 {
+		return nil, nil
+	}
+	entries, err := readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".go") && hasRewriteExt(entry.Name()) {
+			files = append(files, entry.Name())
+		}
+	}
+	return files, nil
+}
+
+// queues the file src of pkg, which has a -rewrite-ext extension, to be rewritten to dest
+// as Go source
+func queueExtRewrite(pkg, dest, src string) {
+	mu.Lock()
+	defer mu.Unlock()
+	pendingRewrites = append(pendingRewrites, rewriteJob{pkg: pkg, dest: dest, src: src, lenient: true})
+}
+
+// reports whether err is the file not parsing as Go
+func isParseError(err error) bool {
+	_, ok := err.(scanner.ErrorList)
+	return ok
+}
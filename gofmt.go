@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"go/format"
+	"sort"
+)
+
+// unformatted are the rewritten files whose content isn't what gofmt would print.
+var unformatted []string
+
+// records the file dest, rewritten to src, if gofmt would print src differently
+func checkGofmt(dest string, src []byte) {
+	formatted, err := format.Source(src)
+	if err == nil && bytes.Equal(formatted, src) {
+		return
+	}
+	mu.Lock()
+	unformatted = append(unformatted, dest)
+	mu.Unlock()
+}
+
+// warns about the rewritten files gofmt would change, listing them under -v
+func reportUnformatted() {
+	if len(unformatted) == 0 {
+		return
+	}
+	sort.Strings(unformatted)
+	infof("Warning: %d rewritten files aren't gofmt-compliant; add -gofmt to print them the way gofmt does", len(unformatted))
+	for _, file := range unformatted {
+		verbosef("  %s", file)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+)
+
+// goListPackage holds the fields of a package described by go list -json that vendorize uses.
+type goListPackage struct {
+	Dir               string
+	ImportPath        string
+	ImportComment     string
+	Name              string
+	Root              string
+	Goroot            bool
+	Standard          bool
+	DepOnly           bool
+	GoFiles           []string
+	CgoFiles          []string
+	IgnoredGoFiles    []string
+	IgnoredOtherFiles []string
+	TestGoFiles       []string
+	XTestGoFiles      []string
+	Imports           []string
+	TestImports       []string
+	XTestImports      []string
+}
+
+// golistPackages are the packages read with -from-golist, keyed by import path. When
+// set, buildPackage only knows about these.
+var golistPackages map[string]*build.Package
+
+// reads the output of go list -json from the file at path, or stdin if path is "-",
+// and returns the import paths of the packages that were listed themselves rather
+// than as dependencies
+func loadGoList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := fsys.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	golistPackages = make(map[string]*build.Package)
+	var roots []string
+	dec := json.NewDecoder(r)
+	for {
+		var p goListPackage
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse go list output: %s", err)
+		}
+		golistPackages[p.ImportPath] = &build.Package{
+			Dir:               canonicalPath(p.Dir),
+			Name:              p.Name,
+			ImportComment:     p.ImportComment,
+			ImportPath:        p.ImportPath,
+			Root:              p.Root,
+			Goroot:            p.Goroot || p.Standard,
+			GoFiles:           p.GoFiles,
+			CgoFiles:          p.CgoFiles,
+			IgnoredGoFiles:    p.IgnoredGoFiles,
+			IgnoredOtherFiles: p.IgnoredOtherFiles,
+			TestGoFiles:       p.TestGoFiles,
+			XTestGoFiles:      p.XTestGoFiles,
+			Imports:           p.Imports,
+			TestImports:       p.TestImports,
+			XTestImports:      p.XTestImports,
+		}
+		if !p.DepOnly {
+			roots = append(roots, p.ImportPath)
+		}
+	}
+	return roots, nil
+}
+
+// returns the package at path as described by go list
+func goListPackageAt(path string) (*build.Package, error) {
+	pkg, ok := golistPackages[path]
+	if !ok {
+		return nil, fmt.Errorf("%s isn't in the go list output", path)
+	}
+	return pkg, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"go/build"
+	"strings"
+)
+
+// reports whether the GOROOT package at path may be vendorized, being given with -allow-goroot
+func gorootAllowed(path string) bool {
+	for _, allowed := range allowGoroot {
+		if path == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// warns, even with -q, that -allow-goroot is about to vendorize standard library packages
+func warnAllowGoroot() {
+	if len(allowGoroot) == 0 {
+		return
+	}
+	errorf("Warning: -allow-goroot vendorizes %s from GOROOT. The copies don't follow Go upgrades, "+
+		"and code importing them gets different types than the rest of the standard library.",
+		strings.Join(allowGoroot, ", "))
+}
+
+// warns about the imports of the GOROOT package pkg that its copy can't import: internal
+// packages of the standard library are only importable from GOROOT
+func checkGorootImports(pkg *build.Package) {
+	for _, imp := range getAllImports(pkg) {
+		if (imp == "internal" || strings.HasPrefix(imp, "internal/") || strings.Contains(imp, "/internal/") ||
+			strings.HasSuffix(imp, "/internal")) && !gorootAllowed(imp) {
+			infof("Warning: %s imports %s, which its copy outside of GOROOT can't import", pkg.ImportPath, imp)
+		}
+	}
+}
+
+// warns about the packages given with -allow-goroot that were never imported
+func reportAllowedGoroot() {
+	for _, path := range allowGoroot {
+		if !visited[path] {
+			infof("Warning: -allow-goroot package %s was never imported", path)
+		}
+	}
+}
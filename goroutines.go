@@ -0,0 +1,35 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// activePackages is the number of packages being vendorized, including those abandoned by
+// -pkg-timeout that are still running. Updated atomically.
+var activePackages int64
+
+// goroutineLogInterval is how often the number of goroutines is logged with -v.
+const goroutineLogInterval = 2 * time.Second
+
+// throttleInterval is how often a throttled queue checks whether it may go on, in case no
+// package finishes in the meantime.
+const throttleInterval = 100 * time.Millisecond
+
+// counts a package as being vendorized until the returned function is called
+func trackActive() func() {
+	atomic.AddInt64(&activePackages, 1)
+	return func() { atomic.AddInt64(&activePackages, -1) }
+}
+
+// reports whether -max-goroutines holds back packages from being started, as many are
+// already being vendorized
+func throttled() bool {
+	return maxGoroutines > 0 && atomic.LoadInt64(&activePackages) >= int64(maxGoroutines)
+}
+
+// logs the number of goroutines running and of packages left, with -v
+func logGoroutines(remaining int) {
+	verbosef("[Goroutines: %d] %d packages being vendorized, %d remaining", runtime.NumGoroutine(), atomic.LoadInt64(&activePackages), remaining)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// graphEdge is an import of the package to by the package from.
+type graphEdge struct {
+	from, to string
+}
+
+var (
+	graphEdges  = make(map[graphEdge]bool) // imports seen while vendorizing, true if only tests make them
+	graphGoroot = make(map[string]bool)    // imported packages found in GOROOT
+)
+
+// records that the package from imports the package to, for -graph, noting whether only
+// its tests do
+func recordEdge(from, to string, goroot, test bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	e := graphEdge{from, to}
+	if seen, ok := graphEdges[e]; !ok || seen {
+		graphEdges[e] = test
+	}
+	if goroot {
+		graphGoroot[to] = true
+	}
+}
+
+// returns the status of the package at path shown in the graph, and its color
+func nodeStatus(path string, m map[string]string) (string, string) {
+	if graphGoroot[path] {
+		return "goroot", "lightblue"
+	}
+	if _, ok := m[path]; ok {
+		return "vendored", "palegreen"
+	}
+	for _, prefix := range blacklistedPrefixes {
+		if hasPackagePrefix(path, prefix) {
+			return "blacklisted", "lightgray"
+		}
+	}
+	return "not copied", "lightsalmon"
+}
+
+// writes the import graph of the vendorized packages to path in Graphviz DOT format
+func writeGraph(path string) error {
+	m := copyRewrites()
+	nodes := make(map[string]bool)
+	var edges []graphEdge
+	for e := range graphEdges {
+		nodes[e.from] = true
+		nodes[e.to] = true
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].from != edges[j].from {
+			return edges[i].from < edges[j].from
+		}
+		return edges[i].to < edges[j].to
+	})
+	var names []string
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph vendorize {\n\tnode [shape=box, style=filled];\n")
+	for _, name := range names {
+		status, color := nodeStatus(name, m)
+		fmt.Fprintf(&buf, "\t%q [tooltip=%q, fillcolor=%q];\n", name, status, color)
+	}
+	for _, e := range edges {
+		if graphEdges[e] {
+			fmt.Fprintf(&buf, "\t%q -> %q [style=dashed];\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", e.from, e.to)
+		}
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	verbosef("Writing graph to %q", path)
+	if dry {
+		return nil
+	}
+	return writeFile(path, &buf, 0660)
+}
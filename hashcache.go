@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hashEntry is the sum of a file cached by -hash-cache, along with the size, times and
+// inode the file had when it was hashed. The modification time alone won't do, as
+// vendorize itself sets it back on the files it copies and rewrites.
+type hashEntry struct {
+	size  int64
+	mtime int64 // in nanoseconds since the epoch
+	ctime int64 // inode change time, in nanoseconds since the epoch
+	ino   int64
+	sum   []byte
+}
+
+// racyInterval is how long after its last change a file's sum is left out of the
+// cache: a file changed again within the resolution of its file system's timestamps would
+// keep its size and times.
+var racyInterval = 2 * time.Second
+
+var (
+	hashCache      map[string]hashEntry // by absolute path, nil without -hash-cache
+	hashCacheRoots []string             // trees hashed in this run, whose deleted files are dropped from the cache
+	hashCacheSeen  = make(map[string]bool)
+	hashCacheHits  int
+)
+
+// reads the -hash-cache file, if it exists. Each line holds the hex sum, the size, the
+// modification and change times in nanoseconds, the inode and the absolute path of a
+// file, in that order.
+func loadHashCache(file string) error {
+	hashCache = make(map[string]hashEntry)
+	data, err := readFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) != 6 {
+			return fmt.Errorf("%s:%d: malformed hash cache line", file, line)
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: malformed sum: %s", file, line, err)
+		}
+		var nums [4]int64
+		for i := range nums {
+			if nums[i], err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+				return fmt.Errorf("%s:%d: malformed number: %s", file, line, err)
+			}
+		}
+		hashCache[fields[5]] = hashEntry{size: nums[0], mtime: nums[1], ctime: nums[2], ino: nums[3], sum: sum}
+	}
+	return scanner.Err()
+}
+
+// notes that the files under root are about to be hashed, so that the cached files under
+// it that aren't found are taken to be deleted
+func hashCacheRoot(root string) {
+	if hashCache == nil {
+		return
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		hashCacheRoots = append(hashCacheRoots, abs)
+	}
+}
+
+// returns the SHA-256 sum of the file at path, described by info, from the cache if
+// neither its size, its times nor its inode changed since it was cached, and hashing it
+// otherwise. Where the change time and inode aren't known, nothing is cached. Only ever
+// called from the main goroutine.
+func cachedFileSum(path string, info os.FileInfo) ([]byte, error) {
+	if hashCache == nil {
+		return fileSum(path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	hashCacheSeen[abs] = true
+	ctime, ino, known := fileChange(info)
+	entry := hashEntry{size: info.Size(), mtime: info.ModTime().UnixNano(), ctime: ctime, ino: ino}
+	if e, ok := hashCache[abs]; ok && known && e.size == entry.size && e.mtime == entry.mtime && e.ctime == entry.ctime && e.ino == entry.ino {
+		hashCacheHits++
+		return e.sum, nil
+	}
+	sum, err := fileSum(path)
+	if err != nil {
+		return nil, err
+	}
+	if known && time.Since(time.Unix(0, ctime)) > racyInterval {
+		entry.sum = sum
+		hashCache[abs] = entry
+	} else {
+		delete(hashCache, abs)
+	}
+	return sum, nil
+}
+
+// reports whether the cached file at path is gone: it is under a tree hashed in this run
+// without having been found there
+func hashCacheGone(path string) bool {
+	if hashCacheSeen[path] {
+		return false
+	}
+	for _, root := range hashCacheRoots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// writes the cache back to file atomically, leaving out the files found deleted. Entries
+// for the files of other trees are kept, so that the cache can be shared by runs on
+// different trees.
+func saveHashCache(file string) error {
+	if hashCache == nil {
+		return nil
+	}
+	var paths []string
+	for path := range hashCache {
+		if hashCacheGone(path) {
+			delete(hashCache, path)
+		} else {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	verbosef("Writing hash cache to %q: %d sums, %d of them reused", file, len(paths), hashCacheHits)
+	if dry {
+		return nil
+	}
+	return replaceFile(file, 0660, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		for _, path := range paths {
+			e := hashCache[path]
+			fmt.Fprintf(bw, "%s %d %d %d %d %s\n", hex.EncodeToString(e.sum), e.size, e.mtime, e.ctime, e.ino, path)
+		}
+		return bw.Flush()
+	})
+}
+
+// saves the -hash-cache, if any, logging rather than failing when it can't be written: the
+// sums computed are right all the same
+func storeHashCache() {
+	if hashCacheFile == "" {
+		return
+	}
+	if err := saveHashCache(hashCacheFile); err != nil {
+		errorf("Couldn't write hash cache %q: %s", hashCacheFile, err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// returns the inode change time of the file described by info, in nanoseconds, and its
+// inode number. The change time moves whenever the file is written or its times are set,
+// so rewrites that restore the modification time still show.
+func fileChange(info os.FileInfo) (ctime, ino int64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int64(st.Ctimespec.Sec)*1e9 + int64(st.Ctimespec.Nsec), int64(st.Ino), true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// checks that every -include is a valid pattern, and that it comes with -skip-hidden
+func checkIncludes() error {
+	if len(includeHidden) > 0 && !skipHidden {
+		return fmt.Errorf("-include only applies with -skip-hidden")
+	}
+	for _, pattern := range includeHidden {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid -include %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// reports whether the file or directory called name is left out by -skip-hidden: its name
+// starts with a dot, and matches no -include pattern
+func skippedHidden(name string) bool {
+	if !skipHidden || !strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, pattern := range includeHidden {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+	return true
+}
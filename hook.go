@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// hookJob is a rewritten file waiting for the -post-rewrite-hook to run on it.
+type hookJob struct {
+	file string      // the rewritten file
+	src  os.FileInfo // the file it was rewritten from, whose modification time it keeps
+}
+
+// pendingHooks are the rewritten files the -post-rewrite-hook is yet to run on.
+var pendingHooks []hookJob
+
+// checks that -post-rewrite-hook combines with the other flags
+func checkPostRewriteHook() error {
+	if postRewriteHook == "" {
+		return nil
+	}
+	if len(strings.Fields(postRewriteHook)) == 0 {
+		return fmt.Errorf("Invalid -post-rewrite-hook: no command given")
+	}
+	if archive != "" {
+		return fmt.Errorf("-post-rewrite-hook can't be used with -archive: the files aren't on disk for the command to run on")
+	}
+	return nil
+}
+
+// queues the -post-rewrite-hook to run on the rewritten file, which was rewritten from
+// the file described by src
+func queueHook(file string, src os.FileInfo) {
+	mu.Lock()
+	defer mu.Unlock()
+	pendingHooks = append(pendingHooks, hookJob{file: file, src: src})
+}
+
+// runs the -post-rewrite-hook on every queued file, as many at once as there are workers,
+// and returns the files it failed on
+func runHooks() map[string]bool {
+	failed := make(map[string]bool)
+	jobs := make(chan hookJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := runHook(job); err != nil {
+					errorf("-post-rewrite-hook failed on %q: %s", job.file, err)
+					mu.Lock()
+					failed[job.file] = true
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, job := range pendingHooks {
+		if isInterrupted() {
+			break
+		}
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+	return failed
+}
+
+// runs the -post-rewrite-hook on the file of job, with {file} in its arguments replaced
+// by the file, or the file appended if none of them mention it. The command is run
+// directly rather than by a shell. Once it has run, the file's checksum is taken again
+// and its modification time restored, since the command may have changed it.
+func runHook(job hookJob) error {
+	args := strings.Fields(postRewriteHook)
+	substituted := false
+	for i, arg := range args {
+		if strings.Contains(arg, "{file}") {
+			args[i] = strings.Replace(arg, "{file}", job.file, -1)
+			substituted = true
+		}
+	}
+	if !substituted {
+		args = append(args, job.file)
+	}
+
+	verbosef("Running %s", strings.Join(args, " "))
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+	if checksumManifest != "" {
+		sum, err := fileSum(job.file)
+		if err != nil {
+			return err
+		}
+		recordSum(job.file, sum)
+	}
+	return keepModTime(job.file, job.src)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// rewrites the canonical import comment of f, as in package foo // import "x/y", to
+// newPath, keeping its comment style. It reports whether f had such a comment to rewrite.
+func rewriteImportComment(fset *token.FileSet, f *ast.File, newPath string) bool {
+	line := fset.Position(f.Package).Line
+	for _, group := range f.Comments {
+		for _, c := range group.List {
+			if c.Slash < f.Name.End() || fset.Position(c.Slash).Line != line {
+				continue
+			}
+			path, block, ok := parseImportComment(c.Text)
+			if !ok || path == newPath {
+				continue
+			}
+			if block {
+				c.Text = "/* import " + strconv.Quote(newPath) + " */"
+			} else {
+				c.Text = "// import " + strconv.Quote(newPath)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// returns the import path of the canonical import comment text, and whether it is a
+// /* */ comment rather than a // one
+func parseImportComment(text string) (path string, block bool, ok bool) {
+	switch {
+	case strings.HasPrefix(text, "//"):
+		text = text[2:]
+	case strings.HasPrefix(text, "/*"):
+		text, block = strings.TrimSuffix(text[2:], "*/"), true
+	default:
+		return "", false, false
+	}
+	fields := strings.Fields(text)
+	if len(fields) != 2 || fields[0] != "import" {
+		return "", false, false
+	}
+	path, err := strconv.Unquote(fields[1])
+	return path, block, err == nil
+}
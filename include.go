@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+)
+
+// returns the packages the crawl starts at with -include-pkg: the package being vendorized,
+// so that -u still rewrites it, along with the included packages
+func includedRoots(pkgName string) ([]string, error) {
+	roots := []string{pkgName}
+	for _, path := range includePkgs {
+		if err := validImportPath(path); err != nil {
+			return nil, fmt.Errorf("Invalid -include-pkg: %s", err)
+		}
+		roots = append(roots, path)
+	}
+	return roots, nil
+}
+
+// reports whether the imports of the package at path are crawled. With -include-pkg,
+// those of the package being vendorized aren't, unless it is included itself, so that
+// only the included packages and their dependencies are vendorized.
+func followsImports(path, pkgName string) bool {
+	if len(includePkgs) == 0 || path != pkgName {
+		return true
+	}
+	for _, included := range includePkgs {
+		if included == pkgName {
+			return true
+		}
+	}
+	return false
+}
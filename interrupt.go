@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interrupted is set once SIGINT or SIGTERM is received. Guarded by mu.
+var interrupted bool
+
+// interrupts is closed once interrupted is set, to wake the loop handing out packages.
+var interrupts = make(chan struct{})
+
+// handles SIGINT and SIGTERM: the first stops new work from being started so that the
+// work in flight can finish, and the second exits at once
+func handleInterrupts() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		mu.Lock()
+		interrupted = true
+		mu.Unlock()
+		close(interrupts)
+		errorf("Received %s: finishing the packages in flight, then stopping. Interrupt again to stop at once.", sig)
+		<-sigs
+		errorf("Received a second interrupt, stopping at once")
+		removePins()
+		os.Exit(130)
+	}()
+}
+
+// reports whether the run was interrupted
+func isInterrupted() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return interrupted
+}
+
+// saves the state file, if there is one, so that the rewrites performed so far aren't lost,
+// and exits with an error
+func exitInterrupted(dest string) {
+	if stateFile != "" {
+		if err := saveState(stateFile, dest); err != nil {
+			errorf("Couldn't write state to %q: %s", stateFile, err)
+		}
+	}
+	fatalf("Interrupted after vendorizing %d imports; run again with -f to finish", len(copyRewrites()))
+}
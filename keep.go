@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// returns the packages reachable over the recorded imports from the packages in from,
+// including those packages themselves. With nonTest, imports made only by tests aren't
+// followed.
+func reachableFrom(from []string, nonTest bool) map[string]bool {
+	imports := make(map[string][]string)
+	for e, test := range graphEdges {
+		if !nonTest || !test {
+			imports[e.from] = append(imports[e.from], e.to)
+		}
+	}
+	reachable := make(map[string]bool)
+	queue := append([]string(nil), from...)
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		if reachable[path] {
+			continue
+		}
+		reachable[path] = true
+		queue = append(queue, imports[path]...)
+	}
+	return reachable
+}
+
+// removes the packages vendorized under root in this run that aren't reachable, logging
+// why with reason, and forgets their rewrites. Packages -dest-map put outside root are
+// left alone. It returns the number of packages removed.
+func pruneUnreachable(root string, reachable map[string]bool, reason string) (int, error) {
+	var unreachable []string
+	for path := range rewrites {
+		if !reachable[path] {
+			unreachable = append(unreachable, path)
+		}
+	}
+	sort.Strings(unreachable)
+
+	gone := make(map[string]bool)
+	for _, path := range unreachable {
+		dir := canonicalPath(filepath.Join(gopath, "src", rewrites[path]))
+		if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			verbosef("Keeping %s: it was vendorized outside %q", path, root)
+			continue
+		}
+		verbosef("Removing %s: %s", path, reason)
+		if err := removePackageDir(root, dir); err != nil {
+			return len(gone), err
+		}
+		gone[path] = true
+		delete(rewrites, path)
+		delete(destDirs, dir)
+	}
+
+	// the files of removed packages mustn't be written back by the rewrite pass
+	kept := pendingRewrites[:0]
+	for _, job := range pendingRewrites {
+		if !gone[job.pkg] {
+			kept = append(kept, job)
+		}
+	}
+	pendingRewrites = kept
+	return len(gone), nil
+}
+
+// removes the files of the package in dir along with its testdata, then dir itself and
+// its parents below root if nothing else is left in them
+func removePackageDir(root, dir string) error {
+	var files, dirs []string
+	err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && path != filepath.Join(dir, "testdata") && filepath.Dir(path) == dir {
+				// another package nested in this one
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := remove(root, file); err != nil {
+			return err
+		}
+	}
+	// remove the deepest directories first, then the parents left empty up to root
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for parent := filepath.Dir(dir); parent != root && len(parent) > len(root); parent = filepath.Dir(parent) {
+		dirs = append(dirs, parent)
+	}
+	removed := files
+	for _, d := range dirs {
+		if empty, err := emptyDir(d, removed); err != nil || !empty {
+			continue
+		}
+		if err := remove(root, d); err != nil {
+			return err
+		}
+		removed = append(removed, d)
+	}
+	return nil
+}
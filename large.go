@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag.Value holding a number of bytes, given with an optional K, M or G
+// suffix, like 5M or 5MB.
+type byteSize int64
+
+// formats the byteSize
+func (b *byteSize) String() string {
+	return formatSize(int64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// returns size in a human friendly unit
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// largeFile is a copied file over the -warn-large threshold.
+type largeFile struct {
+	path string
+	size int64
+}
+
+// largeFiles are the copied files over the -warn-large threshold.
+var largeFiles []largeFile
+
+// warns about the file at path if it is over the -warn-large threshold
+func checkLargeFile(path string, size int64) {
+	if warnLarge <= 0 || size <= int64(warnLarge) {
+		return
+	}
+	infof("Warning: %q is %s, over the -warn-large threshold of %s", path, formatSize(size), formatSize(int64(warnLarge)))
+	mu.Lock()
+	defer mu.Unlock()
+	largeFiles = append(largeFiles, largeFile{path: path, size: size})
+}
+
+// logs the large files copied in this run, largest first
+func reportLargeFiles() {
+	if len(largeFiles) == 0 {
+		return
+	}
+	sort.Slice(largeFiles, func(i, j int) bool {
+		if largeFiles[i].size != largeFiles[j].size {
+			return largeFiles[i].size > largeFiles[j].size
+		}
+		return largeFiles[i].path < largeFiles[j].path
+	})
+	infof("Copied %d files over %s:", len(largeFiles), formatSize(int64(warnLarge)))
+	for _, f := range largeFiles {
+		infof("  %s %s", formatSize(f.size), f.path)
+	}
+}
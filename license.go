@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// licenseUnknown is the license of a package with no license file, or one that isn't
+// recognized, to be reviewed by hand.
+const licenseUnknown = "unknown"
+
+// licenseFilePrefixes are the upper-cased prefixes of the names of license files.
+var licenseFilePrefixes = []string{"LICENSE", "LICENCE", "COPYING", "UNLICENSE"}
+
+// licenseInfo is the license detected for a vendorized package.
+type licenseInfo struct {
+	path    string // import path of the package
+	license string // identifier of the license, or licenseUnknown
+	file    string // license file the license was detected in, if any
+}
+
+// licenseRules classify license texts, after they are lower-cased and their whitespace
+// collapsed: the first rule all of whose phrases appear in a text names its license.
+// Rules for licenses whose texts mention others come first: the MPL names the GPLs as
+// secondary licenses.
+var licenseRules = []struct {
+	license string
+	phrases []string
+}{
+	{"MPL-2.0", []string{"mozilla public license", "2.0"}},
+	{"AGPL-3.0", []string{"gnu affero general public license", "version 3"}},
+	{"LGPL-3.0", []string{"gnu lesser general public license", "version 3"}},
+	{"LGPL-2.1", []string{"gnu lesser general public license", "version 2.1"}},
+	{"GPL-3.0", []string{"gnu general public license", "version 3"}},
+	{"GPL-2.0", []string{"gnu general public license", "version 2"}},
+	{"Apache-2.0", []string{"apache license", "version 2.0"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"ISC", []string{"permission to use, copy, modify, and/or distribute this software for any purpose"}},
+	{"MIT", []string{"permission is hereby granted, free of charge"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+}
+
+// returns the identifier of the license the text of a license file is, or licenseUnknown
+func classifyLicense(text []byte) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(string(text))), " ")
+	for _, rule := range licenseRules {
+		matched := true
+		for _, phrase := range rule.phrases {
+			if !strings.Contains(normalized, phrase) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule.license
+		}
+	}
+	return licenseUnknown
+}
+
+// returns the license file of pkg: the first one in the package directory or, failing
+// that, in the directories above it up to the root of its repository, or of its module
+// when it isn't in one
+func findLicenseFile(pkg *build.Package) (string, error) {
+	root := repoRoot(pkg)
+	if file, ok := findGoMod(pkg.Dir); ok && root == pkg.Dir {
+		root = filepath.Dir(file)
+	}
+	for dir := pkg.Dir; ; dir = filepath.Dir(dir) {
+		entries, err := readDir(dir)
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			name := strings.ToUpper(entry.Name())
+			for _, prefix := range licenseFilePrefixes {
+				if strings.HasPrefix(name, prefix) {
+					return filepath.Join(dir, entry.Name()), nil
+				}
+			}
+		}
+		if dir == root || !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return "", nil
+		}
+	}
+}
+
+// detects the license of pkg
+func detectLicense(pkg *build.Package) licenseInfo {
+	info := licenseInfo{path: pkg.ImportPath, license: licenseUnknown}
+	file, err := findLicenseFile(pkg)
+	if err != nil {
+		infof("Warning: couldn't look for the license of %s: %s", pkg.ImportPath, err)
+	}
+	if file != "" {
+		text, err := readFile(file)
+		if err != nil {
+			infof("Warning: couldn't read the license of %s: %s", pkg.ImportPath, err)
+		} else {
+			info.license, info.file = classifyLicense(text), file
+		}
+	}
+	return info
+}
+
+// returns the license of every vendorized package, sorted by license and then by import
+// path, with the packages whose license is unknown last. Packages vendorized in this run
+// had theirs detected as they were copied; those of earlier runs are detected now.
+func detectLicenses() []licenseInfo {
+	var infos []licenseInfo
+	for path := range copyRewrites() {
+		if m, ok := vendoredMetrics[path]; ok && m.license.path != "" {
+			infos = append(infos, m.license)
+			continue
+		}
+		pkg, err := buildPackage(path)
+		if err != nil {
+			// vendorized by an earlier run, and gone from GOPATH since
+			infof("Warning: no license detected for %s: %s", path, err)
+			infos = append(infos, licenseInfo{path: path, license: licenseUnknown})
+			continue
+		}
+		infos = append(infos, detectLicense(pkg))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if (a.license == licenseUnknown) != (b.license == licenseUnknown) {
+			return b.license == licenseUnknown
+		}
+		if a.license != b.license {
+			return a.license < b.license
+		}
+		return a.path < b.path
+	})
+	return infos
+}
+
+// prints the licenses of the vendorized packages as a table to stdout, followed by the
+// number of packages under each license, and warns about those whose license is unknown
+func printLicenseReport(infos []licenseInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "LICENSE\tPACKAGE\tFILE\n")
+	counts := make(map[string]int)
+	var order []string
+	for _, info := range infos {
+		file := info.file
+		if file == "" {
+			file = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", info.license, info.path, file)
+		if counts[info.license] == 0 {
+			order = append(order, info.license)
+		}
+		counts[info.license]++
+	}
+	w.Flush()
+	outputf("\n")
+	for _, license := range order {
+		outputf("%d packages: %s\n", counts[license], license)
+	}
+	if n := counts[licenseUnknown]; n > 0 {
+		infof("Warning: %d vendorized packages have no license that could be detected; review them by hand", n)
+	}
+}
+
+// writes the licenses of the vendorized packages to path as CSV
+func writeLicenseCSV(path string, infos []licenseInfo) error {
+	verbosef("Writing license report to %q", path)
+	// the report describes what is or would be vendorized, so it is written even with -d
+	return replaceFile(path, 0660, func(out io.Writer) error {
+		w := csv.NewWriter(out)
+		w.Write([]string{"package", "license", "file"})
+		for _, info := range infos {
+			w.Write([]string{info.path, info.license, info.file})
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
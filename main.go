@@ -1,39 +1,177 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"flag"
 	"fmt"
+	"go/ast"
 	"go/build"
+	"go/format"
 	"go/parser"
 	"go/printer"
 	"go/token"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	dry               bool
-	rewrites          map[string]string // rewrites that have been performed
-	visited           map[string]bool   // packages that have already been visited
-	gopath            string            // the last component of GOPATH
-	verbose           bool              // flag to indicate verbose output
-	forceUpdates      bool              // flag to force updating packages already vendorized
-	updateImports     bool              // flag to specify that imports should be updated in files
-	packagesRemaining int               // total number of packages remaining. used to track goroutines still in progress.
+	dry                bool
+	rewrites           map[string]string         // rewrites that have been performed
+	visited            map[string]bool           // packages that have already been visited
+	gopath             string                    // the GOPATH entry holding the package being vendorized, or the last one if none does
+	verbose            bool                      // flag to indicate verbose output
+	quiet              bool                      // flag to suppress all informational output
+	forceUpdates       bool                      // flag to force updating packages already vendorized
+	updateImports      bool                      // flag to specify that imports should be updated in files
+	packagesRemaining  int                       // number of packages queued or being vendorized
+	pkgTimeout         time.Duration             // deadline for vendorizing a single package. zero means no deadline.
+	warnDeprecated     bool                      // flag to warn about vendorizing deprecated packages
+	reportDuplicates   bool                      // flag to report copied files with identical content
+	rewriteRes         stringSliceFlag           // pattern=replacement import path rewrites
+	intoModule         string                    // module path of a go.mod to write at the root of the destination
+	flattenSingleFile  bool                      // flag to relocate single file packages under flattenDir
+	flattenDir         string                    // shared directory under the destination for single file packages
+	noOverwriteNewer   bool                      // flag to keep destination files that are newer than their source
+	archive            string                    // archive file to vendorize into instead of the destination directory
+	resolveVanity      bool                      // flag to vendorize packages at the path given by their import comment
+	stateFile          string                    // file keeping the rewrites of previous runs
+	only               string                    // package whose subgraph is the only one re-vendorized
+	noIgnoredFiles     bool                      // flag to skip files excluded from the build by build constraints
+	sortImports        bool                      // flag to sort the import blocks of rewritten files
+	destSuffix         string                    // suffix appended to the vendored path of every package under the destination
+	preserveRepoLayout bool                      // flag to copy the whole repository a package belongs to
+	rewriteOnly        stringSliceFlag           // import path prefixes of the packages whose files are rewritten
+	maxPathLen         int                       // warn about destination paths longer than this; 0 disables the check
+	serialIO           bool                      // funnel all file system writes through a single goroutine
+	graphFile          string                    // file the import graph is written to in DOT format
+	dereferenceReplace bool                      // resolve packages through the replace directives of the go.mod of the package
+	onConflict         string                    // policy for destination files that already exist
+	prodOnly           bool                      // follow only the non-test imports of packages
+	reportUnusedPkgs   bool                      // list the packages in the destination no import refers to
+	checksumManifest   string                    // file the SHA-256 sums of the destination files are written to
+	verifyManifestFile string                    // checksum manifest the destination is verified against
+	copyMode           string                    // how vendorized files are materialized: copy, move, symlink or hardlink
+	keepReachable      stringSliceFlag           // packages whose transitive imports are kept in the destination
+	normalizeEOL       string                    // line ending text files are converted to while copying
+	planFile           string                    // file the actions of a dry run are written to as JSON
+	warnLarge          byteSize                  // size over which copied files are warned about
+	tmpDir             string                    // directory temp files are written to before being renamed into place
+	skipCgo            bool                      // flag to skip packages that use cgo
+	skipNames          stringSliceFlag           // package names of packages that aren't copied
+	fromGolist         string                    // file holding go list -json output to vendorize from, or - for stdin
+	excludeTestOnly    bool                      // flag to remove packages that only tests import
+	buildTags          string                    // comma-separated build tags packages are evaluated with
+	pluginPackages     bool                      // follow and rewrite the imports of files excluded by build constraints
+	gofmtOutput        bool                      // flag to print rewritten files the way gofmt does
+	maxDepthWarn       int                       // warn when the deepest dependency chain has more imports than this; 0 disables the warning
+	destMapFile        string                    // file mapping import paths to the import path each is vendorized at
+	noColor            bool                      // flag to never color the logged package statuses
+	dumpImports        bool                      // flag to log the import lists of every package visited
+	fileMode           fileModeFlag              // permissions vendorized files are written with instead of those of their source
+	skipInCache        bool                      // flag to skip packages the module cache has at the version the go.mod requires
+	verifyGofmt        bool                      // flag to report rewritten files that are not formatted the way gofmt would
+	preflightOnly      bool                      // flag to only check that a run could succeed
+	compareWith        string                    // vendor tree the destination is compared with instead of vendorizing
+	rewriteGlobs       stringSliceFlag           // name patterns of the non-Go files whose import paths are rewritten textually
+	vendorSpec         string                    // file a Godeps.json listing the vendorized packages and their revisions is written to
+	rewriteCanonical   bool                      // flag to rewrite the canonical import comments of vendorized packages to their vendored path
+	minGo              string                    // oldest Go release the vendorized packages are checked to build with
+	rewriteSummary     bool                      // print how many imports were rewritten in each package
+	srcRoots           stringSliceFlag           // directories laid out like GOPATH entries that packages are also resolved in
+	flagCacheSource    bool                      // log whether each package was copied from the module cache
+	failOnBlacklisted  bool                      // fail when a vendorized package imports a blacklisted one
+	deterministic      bool                      // vendorize one package at a time in sorted order, for byte-stable output
+	postRewriteHook    string                    // command run on every file rewritten by -u
+	explain            bool                      // print what became of every package encountered, and why
+	updateRoot         string                    // project directory every Go file of which is rewritten
+	budgetFiles        int64                     // most files the whole run may copy
+	budgetBytes        byteSize                  // most bytes the whole run may copy
+	normalizeImports   bool                      // tidy the aliases of rewritten imports
+	rewriteExts        stringSliceFlag           // extensions of the files other than Go files rewritten as Go source
+	maxGoroutines      int                       // most packages vendorized at once, abandoned ones included
+	pins               stringSliceFlag           // importpath=version pairs of packages whose repositories are vendorized at that version
+	reportLicenses     bool                      // print the detected license of every vendorized package
+	licenseCSV         string                    // file to write the detected licenses to as CSV
+	dumpTree           bool                      // print the destination tree once the run is done
+	followSymlinks     bool                      // copy packages reached through symbolic links from where the links point, rather than linking to them
+	rewriteTests       bool                      // whether -u rewrites test files too
+	allowGoroot        stringSliceFlag           // import paths of GOROOT packages that are vendorized anyway
+	skipHidden         bool                      // leave out files and directories whose name starts with a dot
+	includeHidden      stringSliceFlag           // patterns of hidden files copied despite -skip-hidden
+	minFanIn           int                       // keep only the vendorized packages imported by at least this many packages of the graph
+	maxFanIn           int                       // keep only the vendorized packages imported by at most this many packages of the graph
+	rewriteFromTo      stringSliceFlag           // old=new import path rewrites applied to -dir instead of vendorizing
+	rewriteDir         string                    // directory rewritten by -rewrite-from-to
+	summaryOnly        bool                      // flag to log nothing but errors until the summary at the end of the run
+	hashCacheFile      string                    // file caching the sums of files by path, size and modification time
+	rootOnlyRewrite    bool                      // flag to leave the vendorized copies importing the original paths with -u
+	skipUnparseable    bool                      // flag to leave Go files that fail to parse as copied rather than failing their package
+	includePkgs        stringSliceFlag           // packages whose dependencies alone are vendorized
+	mirror             bool                      // flag to make the destination an exact mirror of the dependency graph
+	failures           int                       // number of packages that failed to vendorize
+	succeeded          int                       // number of packages vendorized, whether copied or rewritten in place
+	skipped            int                       // number of packages skipped for a benign reason
+	trimPath           string                    // import path prefix stripped before computing vendored paths
+	vendorDest         string                    // import path prefix of the destination
+	claimed            map[string]*build.Package // vendored import paths mapped to the package vendorized there
+	destDirs           map[string]string         // destination dirs of vendorized packages mapped to their source dirs
+	mu                 sync.Mutex                // guards rewrites, visited, claimed and destDirs across goroutines
 )
 
 // stringSliceFlag is a flag.Value that accumulates multiple flags in to a slice.
 type stringSliceFlag []string
 
 type vendorizeResult struct {
-	path string
-	err  error
+	path    string
+	status  resultStatus
+	err     error      // why the package failed, only set with statusFailed
+	skip    skipReason // why the package wasn't copied, with statusSkipped
+	why     string     // details of skip
+	imports []string   // import paths the package depends on that are still to be vendorized
+	metrics packageMetrics
+}
+
+// resultStatus is how vendorizing a package went.
+type resultStatus int
+
+const (
+	statusVendorized resultStatus = iota // copied, or its files rewritten in place
+	statusSkipped                        // left alone for a benign reason, given by skip
+	statusFailed                         // something went wrong, given by err
+)
+
+// skipReason is why a package was left alone without anything having gone wrong.
+type skipReason string
+
+const (
+	skipVisited     skipReason = "already visited"
+	skipFiltered    skipReason = "filtered"
+	skipPreexisting skipReason = "preexisting"
+	skipIgnored     skipReason = "not copied" // blacklisted, or already vendorized; its files are still rewritten
+)
+
+// describes why the result's package was skipped
+func (r vendorizeResult) skipMessage() string {
+	switch r.skip {
+	case skipVisited:
+		return fmt.Sprintf("Path '%v' already visited... skipping", r.path)
+	case skipFiltered:
+		return fmt.Sprintf("Skipped %s: %s", r.path, r.why)
+	case skipPreexisting:
+		return fmt.Sprintf("Ignored (preexisting): %q", r.why)
+	}
+	return fmt.Sprintf("Not copying %s: %s", r.path, r.why)
 }
 
 // formats the stringSliceFlag
@@ -52,261 +190,1373 @@ var blacklistedPrefixes stringSliceFlag
 // builtPackages maintains a cache of package builds.
 var builtPackages map[string]*build.Package
 
+// workers is the number of packages vendorized at once. Vendorizing is mostly waiting on
+// the file system, so there are more workers than CPUs.
+var workers = 4 * runtime.NumCPU()
+
 func main() {
 
 	start := time.Now()
 
 	flag.BoolVar(&dry, "d", false, "If true, perform a dry run but don't execute anything.")
 	flag.BoolVar(&verbose, "v", false, "Provide verbose output")
+	flag.BoolVar(&quiet, "q", false, "If true, suppress all informational output. Errors are still logged.")
 	flag.Var(&blacklistedPrefixes, "b", "Package prefix to blacklist. Can be given multiple times.")
 	flag.BoolVar(&forceUpdates, "f", false, "If true, forces updates on already vendorized packages.")
 	flag.BoolVar(&updateImports, "u", false, "If true, updates import statements for vendorized packages.")
+	flag.BoolVar(&warnDeprecated, "warn-deprecated", false, "If true, warns about vendorized packages marked Deprecated in their doc.")
+	flag.BoolVar(&mirror, "mirror", false, "If true, forces updates and removes everything in the destination that isn't part of the dependency graph.")
+	flag.BoolVar(&reportDuplicates, "report-dupes", false, "If true, reports copied files with identical content and the bytes they waste.")
+	flag.DurationVar(&pkgTimeout, "pkg-timeout", 0, "Maximum time to spend vendorizing a single package, e.g. 30s. Zero means no limit.")
+	flag.Var(&rewriteRes, "rewrite-re", "Import path rewrite of the form pattern=replacement, e.g. 'golang.org/x/(.*)=myvendor/x/$1'. Can be given multiple times.")
+	flag.StringVar(&intoModule, "into-module", "", "If set, writes a go.mod declaring this module path at the root of the destination.")
+	flag.BoolVar(&flattenSingleFile, "flatten-single-file", false, "If true, places packages made of a single Go file under a shared directory in the destination.")
+	flag.StringVar(&flattenDir, "flatten-dir", "single", "Directory under the destination used by -flatten-single-file.")
+	flag.BoolVar(&noOverwriteNewer, "no-overwrite-newer", false, "If true, files newer than their source are never overwritten, even with -f.")
+	flag.StringVar(&archive, "archive", "", "If set, vendorizes into this .tar, .tar.gz, .tgz or .zip file instead of the destination directory.")
+	flag.BoolVar(&resolveVanity, "resolve-vanity", false, "If true, vendorizes packages at their canonical import path when it differs from the path they are imported by.")
+	flag.StringVar(&stateFile, "state", "", "If set, reads the rewrites of previous runs from this file and merges the new ones into it.")
+	flag.StringVar(&only, "only", "", "If set, re-vendorizes only this package and its dependencies. Requires -state.")
+	flag.BoolVar(&noIgnoredFiles, "no-ignored-files", false, "If true, files excluded from the build by build constraints aren't copied.")
+	flag.BoolVar(&sortImports, "sort-imports", false, "If true, sorts the import blocks of files rewritten by -u the way gofmt does.")
+	flag.StringVar(&destSuffix, "dest-suffix", "", "Suffix appended to the vendored path of every package, e.g. .v1 to vendor two versions side by side.")
+	flag.BoolVar(&preserveRepoLayout, "preserve-repo-layout", false, "If true, copies the whole repository each package belongs to, preserving its directory layout.")
+	flag.Var(&rewriteOnly, "rewrite-only-prefix", "If set, -u only rewrites files of packages under this import path prefix. Can be given multiple times.")
+	flag.IntVar(&maxPathLen, "max-path-len", 0, "If greater than zero, warn about destination file paths longer than this many characters.")
+	flag.BoolVar(&serialIO, "serial-io", false, "If true, perform all file system writes from a single goroutine, one at a time.")
+	flag.StringVar(&graphFile, "graph", "", "If set, write the import graph of the vendorized packages to this file in Graphviz DOT format.")
+	flag.BoolVar(&dereferenceReplace, "dereference-replace", false, "If true, copy packages from where the replace directives in the go.mod of the package point, keeping their original import paths.")
+	flag.StringVar(&onConflict, "on-conflict", "", "What to do with destination files that already exist: skip, overwrite, error or backup. Defaults to skip, or overwrite with -f.")
+	flag.BoolVar(&prodOnly, "prod-only", false, "If true, only vendorize the packages needed to build the package, ignoring test imports at every level.")
+	flag.BoolVar(&reportUnusedPkgs, "report-unused", false, "If true, list the packages in the destination that no import refers to after the run, without removing them.")
+	flag.StringVar(&checksumManifest, "checksum-manifest", "", "If set, write the SHA-256 sum of every file in the destination to this file, in the format of sha256sum.")
+	flag.StringVar(&verifyManifestFile, "verify-manifest", "", "If set, verify the destination against this checksum manifest instead of vendorizing, and fail on any difference.")
+	flag.StringVar(&copyMode, "copy-mode", copyModeCopy, "How to put files into the destination: copy, move, symlink or hardlink.")
+	flag.Var(&keepReachable, "keep-reachable-from", "If set, remove the vendorized packages this package does not import, directly or indirectly, once every package is vendorized. Can be given multiple times.")
+	flag.StringVar(&normalizeEOL, "normalize-eol", "", "If set to lf or crlf, convert the line endings of copied text files. Binary files are copied as is.")
+	flag.StringVar(&planFile, "plan-json", "", "If set with -d, write the actions the dry run would have performed to this file as a JSON array.")
+	flag.Var(&warnLarge, "warn-large", "If set, warn about copied files larger than this size, like 5MB.")
+	flag.StringVar(&tmpDir, "tmpdir", "", "If set, the directory temp files are written to before being renamed, or copied when on another file system, into place. Defaults to the directory of the file being replaced.")
+	flag.BoolVar(&skipCgo, "skip-cgo", false, "If true, don't copy packages that use cgo. Their imports are still vendorized.")
+	flag.Var(&skipNames, "skip-name", "Package name, like main, of packages not to copy. Their imports are still vendorized. Can be given multiple times.")
+	flag.StringVar(&fromGolist, "from-golist", "", "If set, vendorize the packages described by the go list -json output in this file, or stdin if -, instead of resolving them.")
+	flag.BoolVar(&excludeTestOnly, "exclude-test-only-deps", false, "If true, remove the vendorized packages that are only imported by tests, anywhere in the graph, once every package is vendorized.")
+	flag.StringVar(&buildTags, "tags", "", "A comma-separated list of build tags to consider satisfied when evaluating build constraints, as with go build -tags.")
+	flag.BoolVar(&pluginPackages, "plugin-packages", false, "If true, the imports of files excluded by build constraints, like plugin-only or other platform files, are vendorized and rewritten too.")
+	flag.BoolVar(&gofmtOutput, "gofmt", false, "If true, files rewritten by -u are printed the way gofmt prints them, comments included, so their formatting is the same from one run to the next.")
+	flag.IntVar(&maxDepthWarn, "max-depth-warn", 0, "If positive, warn when the deepest chain of imports from the package to a dependency is longer than this. The deepest chain is always logged with -v.")
+	flag.StringVar(&destMapFile, "dest-map", "", "If set, a file of importpath=destpath lines giving the import path specific packages are vendorized at, instead of one under the destination.")
+	flag.BoolVar(&noColor, "no-color", false, "If true, package statuses are never colored. They are only colored when stderr is a terminal and NO_COLOR is unset.")
+	flag.BoolVar(&dumpImports, "dump-imports", false, "If true, log the imports, test imports and external test imports of every package visited, each list on its own.")
+	flag.Var(&fileMode, "file-mode", "If set, the octal permissions, like 0444, every vendorized file is written with instead of the permissions of its source.")
+	flag.BoolVar(&skipInCache, "skip-in-cache", false, "If true, don't copy packages the module download cache holds at the version the go.mod of the package requires. Their imports are still vendorized.")
+	flag.BoolVar(&verifyGofmt, "verify-gofmt", false, "If true, report the files rewritten by -u that gofmt would format differently.")
+	flag.BoolVar(&preflightOnly, "preflight", false, "If true, only check that the destination is writable and that every package in the dependency graph can be imported, without copying or rewriting anything.")
+	flag.StringVar(&compareWith, "compare-with", "", "If set, compare the destination with the vendor tree in this directory instead of vendorizing, listing the packages added, removed and changed.")
+	flag.Var(&rewriteGlobs, "rewrite-glob", "Name pattern, like '*.go.tmpl', of files other than Go files in which -u replaces the import paths of vendorized packages as plain text. Can be given multiple times.")
+	flag.StringVar(&vendorSpec, "vendor-spec", "", "If set, write the vendorized packages and the revisions of their repositories to this file in the Godeps.json format.")
+	flag.BoolVar(&rewriteCanonical, "rewrite-canonical-import-comment", false, "If true, -u rewrites the canonical import comments, like package foo // import \"x/y\", of vendorized packages to their vendored path, so that the go tool accepts them there.")
+	flag.StringVar(&minGo, "min-go", "", "If set, warn about vendorized packages that need a newer Go than this release, like go1.16, going by their build constraints and go.mod.")
+	flag.BoolVar(&rewriteSummary, "rewrite-dry-summary", false, "If true, print how many imports -u rewrote across how many files of each package at the end of the run.")
+	flag.Var(&srcRoots, "src-root", "Directory laid out like a GOPATH entry, with a src directory, in which packages not found in GOPATH are resolved. Nothing is copied into it. Can be given multiple times.")
+	flag.BoolVar(&flagCacheSource, "flag-cache-source", false, "If true, log which vendorized packages were copied from the module cache rather than from a workspace, and record it in the -vendor-spec.")
+	flag.BoolVar(&failOnBlacklisted, "fail-on-blacklisted-transitive", false, "If true, fail rather than warn when a vendorized package imports a package blacklisted with -b, as the destination is then incomplete.")
+	flag.BoolVar(&deterministic, "deterministic", false, "If true, vendorize one package at a time in sorted order and archive every file with the same modification time, so that the output is the same on every run. This is slower.")
+	flag.StringVar(&postRewriteHook, "post-rewrite-hook", "", "If set, a command, like 'goimports -w {file}', run on every file -u rewrites, with {file} replaced by the file. A command failing counts as a failure of the package.")
+	flag.BoolVar(&explain, "explain", false, "If true, print what became of every package encountered, copied, skipped or failed, and why, at the end of the run.")
+	flag.StringVar(&updateRoot, "update-all-imports-in-root", "", "If set, the project directory every Go file in which, outside of the destination, has its imports rewritten to the vendored packages. Implies -u.")
+	flag.Int64Var(&budgetFiles, "budget-files", 0, "If set, the most files the whole run may copy. The run is stopped, and fails, as soon as it would copy more.")
+	flag.Var(&budgetBytes, "budget-bytes", "If set, the most bytes, like 50M, the whole run may copy. The run is stopped, and fails, as soon as it would copy more.")
+	flag.BoolVar(&normalizeImports, "normalize-imports", false, "If true, -u gives rewritten imports whose new path no longer ends in their package name that name as an alias, and drops aliases that merely repeat it.")
+	flag.Var(&rewriteExts, "rewrite-ext", "Extension, like .go.in, of files other than Go files that -u rewrites the imports of as Go source. Files that don't parse are warned about and left alone. Can be given multiple times.")
+	flag.IntVar(&maxGoroutines, "max-goroutines", 0, "If set, the most packages vendorized at once, counting those abandoned by -pkg-timeout that are still running. New ones wait until enough finish.")
+	flag.Var(&pins, "at", "An importpath=version pair, like github.com/a/b=v1.2.0: the repository of the package is vendorized as checked out at that tag or revision, from a temporary clone that leaves the original alone. Can be given multiple times.")
+	flag.BoolVar(&reportLicenses, "report-licenses", false, "If true, prints a table of the license detected for every vendorized package and its license file, sorted by license, with the number of packages under each. Packages whose license isn't detected are listed as unknown.")
+	flag.StringVar(&licenseCSV, "license-report-csv", "", "If set, a file to write the license detected for every vendorized package to, as CSV.")
+	flag.BoolVar(&dumpTree, "dump-tree", false, "If true, prints the destination directory tree to stdout once the run is done. With -d, the tree is the one the run would have left.")
+	flag.BoolVar(&followSymlinks, "follow-symlinked-packages", true, "If true, packages whose directory is reached through a symbolic link in GOPATH are copied from where the link points. If false, the link is preserved: the destination gets a link to the same directory instead of a copy.")
+	flag.BoolVar(&rewriteTests, "rewrite-tests", true, "If false, -u leaves the imports of test files alone, rewriting only the other Go files.")
+	flag.Var(&allowGoroot, "allow-goroot", "DANGEROUS: import path of a standard library package, like container/list, to vendorize from GOROOT and rewrite the imports of like any other, for a patched copy. Can be given multiple times.")
+	flag.BoolVar(&skipHidden, "skip-hidden", false, "If true, files whose name starts with a dot, like .gitignore, aren't copied, nor are such directories with -preserve-repo-layout or testdata.")
+	flag.Var(&includeHidden, "include", "With -skip-hidden, a pattern, like .gitattributes or '.*.yml', of hidden files and directories to copy anyway. Can be given multiple times.")
+	flag.IntVar(&minFanIn, "min-fan-in", 0, "If positive, remove the vendorized packages imported by fewer than this many of the packages crawled, once every package is vendorized.")
+	flag.IntVar(&maxFanIn, "max-fan-in", 0, "If positive, remove the vendorized packages imported by more than this many of the packages crawled, once every package is vendorized.")
+	flag.Var(&rewriteFromTo, "rewrite-from-to", "Import path rewrite of the form old=new, like github.com/old/lib=github.com/new/lib, applied in place to the Go files under -dir instead of vendorizing. Nothing is copied, and no arguments are needed. Can be given multiple times.")
+	flag.StringVar(&rewriteDir, "dir", "", "With -rewrite-from-to, the directory whose Go files are rewritten. Defaults to the current directory.")
+	flag.BoolVar(&summaryOnly, "summary-only", false, "If true, log nothing but errors, like packages failing, until the summary at the end of the run.")
+	flag.StringVar(&hashCacheFile, "hash-cache", "", "If set, a file caching the sums of the files hashed by -verify-manifest, -compare-with and -checksum-manifest, so that files whose size and modification time haven't changed aren't hashed again by later runs.")
+	flag.BoolVar(&rootOnlyRewrite, "root-only-rewrite", false, "If true, -u leaves the vendorized copies importing the original paths, and only rewrites the package being vendorized and the rest of the project. Into a vendor directory of the package, which the go tool resolves the original paths in, nothing is rewritten.")
+	flag.BoolVar(&skipUnparseable, "skip-unparseable", false, "If true, Go files whose imports -u can't rewrite because they fail to parse are warned about and left as copied, rather than failing their package.")
+	flag.Var(&includePkgs, "include-pkg", "Exact import path of a package, like github.com/project/repo/cmd/tool, whose dependencies are vendorized instead of those of the package being vendorized. Can be given multiple times.")
+	flag.StringVar(&trimPath, "trim-path", "", "Import path prefix to strip before computing vendored paths.")
 	flag.Parse()
 
+	// rewrite an existing tree rather than vendorize
+	if rewriteDir != "" && len(rewriteFromTo) == 0 {
+		log.Fatal("-dir only applies with -rewrite-from-to")
+	}
+	if len(rewriteFromTo) > 0 {
+		m, err := parseFromTo(rewriteFromTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := parseRewritePatterns(rewriteRes); err != nil {
+			log.Fatal(err)
+		}
+		if err := checkPostRewriteHook(); err != nil {
+			log.Fatal(err)
+		}
+		if rewriteDir == "" {
+			rewriteDir = "."
+		}
+		failed, err := rewriteTree(rewriteDir, m)
+		if err != nil {
+			log.Fatalf("Couldn't list the Go files of %q: %s", rewriteDir, err)
+		}
+		if failed > 0 {
+			log.Fatalf("%d files failed to rewrite", failed)
+		}
+		return
+	}
+
 	// set the go path
-	gopaths := filepath.SplitList(os.Getenv("GOPATH"))
-	gopath = gopaths[len(gopaths)-1]
+	gopaths := filepath.SplitList(goEnv("GOPATH"))
+	if len(gopaths) > 0 {
+		gopath = gopaths[len(gopaths)-1]
+	}
 	if gopath == "" {
 		log.Fatal("GOPATH must be set")
 	}
+	gopath = canonicalPath(gopath)
 
 	// set the package name from arguments
-	pkgName := flag.Arg(0)
+	pkgName := os.ExpandEnv(flag.Arg(0))
 	if pkgName == "" {
 		log.Fatal("Package name required")
 	}
 
 	// set the destination from arguments
-	dest := flag.Arg(1)
+	dest := os.ExpandEnv(flag.Arg(1))
 	if dest == "" {
 		log.Fatal("Destination path required")
 	}
+	dest, err := normalizeDest(dest)
+	if err != nil {
+		log.Fatalf("Invalid destination: %s", err)
+	}
+
+	// copy into the GOPATH entry holding the package, where go/build finds it and its
+	// vendorized dependencies, rather than into the last one
+	if entries := gopathEntries(pkgName); len(entries) > 0 && entries[0] != gopath {
+		verbosef("Copying into %q, the GOPATH entry holding %s", entries[0], pkgName)
+		gopath = entries[0]
+	}
+
+	if flattenSingleFile {
+		if err := validImportPath(flattenDir); err != nil {
+			log.Fatalf("Invalid -flatten-dir: %s", err)
+		}
+	}
+
+	if destSuffix != "" {
+		if err := validImportPath("x" + destSuffix); err != nil {
+			log.Fatalf("Invalid -dest-suffix: %s", err)
+		}
+	}
 
+	// expand environment variables the shell didn't, as in arguments from config files
+	for i := range blacklistedPrefixes {
+		blacklistedPrefixes[i] = os.ExpandEnv(blacklistedPrefixes[i])
+	}
+	for i := range rewriteOnly {
+		rewriteOnly[i] = os.ExpandEnv(rewriteOnly[i])
+	}
+
+	if err := parseRewritePatterns(rewriteRes); err != nil {
+		log.Fatal(err)
+	}
+	if destMapFile != "" {
+		if err := loadDestMap(destMapFile); err != nil {
+			log.Fatalf("Invalid -dest-map: %s", err)
+		}
+	}
+
+	if planFile != "" && !dry {
+		log.Fatal("-plan-json requires -d")
+	}
+
+	if hashCacheFile != "" {
+		if verifyManifestFile == "" && compareWith == "" && checksumManifest == "" {
+			log.Fatal("-hash-cache only applies with -verify-manifest, -compare-with or -checksum-manifest")
+		}
+		if err := loadHashCache(hashCacheFile); err != nil {
+			log.Fatalf("Couldn't read hash cache %q: %s", hashCacheFile, err)
+		}
+	}
+
+	if verifyManifestFile != "" {
+		problems, err := verifyManifest(verifyManifestFile, filepath.Join(gopath, "src", dest))
+		if err != nil {
+			log.Fatalf("Couldn't verify %q: %s", verifyManifestFile, err)
+		}
+		storeHashCache()
+		if problems > 0 {
+			log.Fatalf("%d files differ from %q", problems, verifyManifestFile)
+		}
+		infof("%q matches %q", dest, verifyManifestFile)
+		return
+	}
+
+	if compareWith != "" {
+		if err := compareTrees(filepath.Join(gopath, "src", dest), compareWith); err != nil {
+			log.Fatalf("Couldn't compare with %q: %s", compareWith, err)
+		}
+		storeHashCache()
+		return
+	}
+
+	setupPackageFilters()
+	if err := checkCopyMode(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkNormalizeEOL(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkFileMode(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkRewriteGlobs(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkRewriteExts(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkMinGo(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkPostRewriteHook(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkSrcRoots(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkFollowSymlinks(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkIncludes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkFanIn(); err != nil {
+		log.Fatal(err)
+	}
+	if summaryOnly && verbose {
+		log.Fatal("-summary-only can't be used with -v")
+	}
+	if err := checkPluginPackages(); err != nil {
+		log.Fatal(err)
+	}
+	setupColor()
+
+	if mirror {
+		forceUpdates = true
+	}
+	if updateRoot != "" {
+		updateImports = true
+	}
+	if err := checkRootOnlyRewrite(); err != nil {
+		log.Fatal(err)
+	}
+	setupRootOnlyRewrite(dest, pkgName)
+
+	roots := []string{pkgName}
+	if only != "" {
+		if stateFile == "" {
+			log.Fatal("-only requires -state")
+		}
+		if mirror {
+			log.Fatal("-mirror can't be used with -only")
+		}
+		roots = []string{only}
+		forceUpdates = true
+	}
+	// after -mirror and -only, which overwrite existing files too
+	if err := checkOnConflict(); err != nil {
+		log.Fatal(err)
+	}
+
+	if fromGolist != "" {
+		if only != "" {
+			log.Fatal("-only can't be used with -from-golist")
+		}
+		listed, err := loadGoList(fromGolist)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(listed) > 0 {
+			roots = listed
+		}
+	}
+
+	if len(includePkgs) > 0 {
+		if only != "" || fromGolist != "" {
+			log.Fatal("-include-pkg can't be used with -only or -from-golist")
+		}
+		var err error
+		if roots, err = includedRoots(pkgName); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var arch *archiveFS
+	if archive != "" {
+		if mirror {
+			log.Fatal("-mirror can't be used with -archive")
+		}
+		var err error
+		arch, err = newArchiveFS(archive, filepath.Join(gopath, "src", dest))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fsys = arch
+	}
+	if serialIO {
+		fsys = newSerialFS(fsys)
+	}
+
+	if foldsCase = caseInsensitive(filepath.Join(gopath, "src")); foldsCase {
+		verbosef("%q ignores case: vendored paths differing only in case are rejected", filepath.Join(gopath, "src"))
+	}
+
+	userBlacklist = append([]string(nil), blacklistedPrefixes...)
 	blacklistedPrefixes = append(blacklistedPrefixes, pkgName)
 	blacklistedPrefixes = append(blacklistedPrefixes, dest)
+	vendorDest = dest
+	logConfig(pkgName, dest)
 	rewrites = make(map[string]string)
 	visited = make(map[string]bool)
+	claimed = make(map[string]*build.Package)
+	destDirs = make(map[string]string)
+
+	if stateFile != "" {
+		if err := loadState(stateFile, dest); err != nil {
+			log.Fatalf("Couldn't read state from %q: %s", stateFile, err)
+		}
+	}
+
+	if dereferenceReplace {
+		pkg, err := buildPackage(pkgName)
+		if err != nil {
+			log.Fatalf("Couldn't import %s: %s", pkgName, err)
+		}
+		if file, ok := findGoMod(pkg.Dir); ok {
+			if err := loadGoModReplaces(file); err != nil {
+				log.Fatalf("Couldn't read replace directives: %s", err)
+			}
+		} else {
+			infof("Warning: no go.mod found for %s, so there are no replace directives to honor", pkgName)
+		}
+	}
 
-	ch := make(chan vendorizeResult)
+	if skipInCache {
+		pkg, err := buildPackage(pkgName)
+		if err != nil {
+			log.Fatalf("Couldn't import %s: %s", pkgName, err)
+		}
+		if file, ok := findGoMod(pkg.Dir); ok {
+			if err := loadGoModRequires(file); err != nil {
+				log.Fatalf("Couldn't read require directives: %s", err)
+			}
+		} else {
+			infof("Warning: no go.mod found for %s, so no package is left to the module cache", pkgName)
+		}
+	}
 
-	packagesRemaining++
-	go vendorize(pkgName, dest, ch)
+	if err := setupPins(); err != nil {
+		removePins()
+		log.Fatal(err)
+	}
+	defer removePins()
 
+	if preflightOnly {
+		if problems := preflight(roots, dest); problems > 0 {
+			fatalf("Preflight found %d problems", problems)
+		}
+		return
+	}
+
+	handleInterrupts()
+	warnAllowGoroot()
+
+	if deterministic {
+		// one package at a time, in a fixed order, so that nothing depends on which
+		// worker finishes first
+		workers = 1
+	}
+	if maxGoroutines > 0 && workers > maxGoroutines {
+		workers = maxGoroutines
+	}
+
+	// packages are vendorized by a fixed number of workers fed from an explicit queue, so
+	// that neither the depth nor the width of the graph decides how many goroutines run.
+	// Results are buffered for every worker, so one finishing never waits on the loop below
+	// being busy with another's result; the counts are only ever touched by the loop.
+	jobs := make(chan string)
+	ch := make(chan vendorizeResult, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for path := range jobs {
+				ch <- vendorize(path, dest)
+			}
+		}()
+	}
+
+	queued := make(map[string]bool)
+	var queue []string
+	for _, root := range roots {
+		recordParent(root, "")
+	}
+	for _, root := range roots {
+		if !queued[root] {
+			queued[root] = true
+			queue = append(queue, root)
+			packagesRemaining++
+		}
+	}
+
+	var logTick <-chan time.Time // nil, and so never ready, without -v
+	if verbose {
+		ticker := time.NewTicker(goroutineLogInterval)
+		defer ticker.Stop()
+		logTick = ticker.C
+	}
+	wasThrottled := false
+	stopping := interrupts // set to nil once the interrupt is seen
 	for packagesRemaining > 0 {
+		if isInterrupted() && len(queue) > 0 {
+			// only the packages in flight are finished
+			packagesRemaining -= len(queue)
+			queue = nil
+		}
+		var next chan string // nil, and so never ready, while the queue is empty
+		var job string
+		var recheck <-chan time.Time
+		if len(queue) > 0 {
+			if throttled() {
+				if !wasThrottled {
+					infof("Throttling: %d packages are being vendorized, the most -max-goroutines allows; waiting for some to finish", atomic.LoadInt64(&activePackages))
+				}
+				wasThrottled = true
+				recheck = time.After(throttleInterval)
+			} else {
+				wasThrottled = false
+				next, job = jobs, queue[0]
+			}
+		}
 		select {
+		case next <- job:
+			queue = queue[1:]
+		case <-recheck:
+		case <-stopping:
+			stopping = nil
+		case <-logTick:
+			logGoroutines(packagesRemaining)
 		case r := <-ch:
 
+			mu.Lock()
 			visited[r.path] = true
+			mu.Unlock()
 			packagesRemaining--
+			switch r.status {
+			case statusVendorized:
+				succeeded++
+				recordMetrics(r)
+			case statusSkipped:
+				skipped++
+			case statusFailed:
+				failures++
+			}
+			recordBlacklistedImports(r.path, r.imports)
+			follow := followsImports(r.path, pkgName)
+			for _, imp := range r.imports {
+				if follow && !queued[imp] && !isInterrupted() {
+					queued[imp] = true
+					recordParent(imp, r.path)
+					queue = append(queue, imp)
+					packagesRemaining++
+				}
+			}
+			if deterministic {
+				sort.Strings(queue)
+			}
+			if budgetExceeded() != nil && len(queue) > 0 {
+				// nothing more may be copied, so don't start on the rest
+				packagesRemaining -= len(queue)
+				queue = nil
+			}
 
-			if r.err != nil {
-				verbosef("[Packages Remaining: %d] %s\n", packagesRemaining, r.err.Error())
-			} else {
-				verbosef("[Packages Remaining: %d] Package vendorized %s\n", packagesRemaining, r.path)
+			if explain {
+				recordExplanation(r)
+			}
+			switch r.status {
+			case statusFailed:
+				errorf("[Packages Remaining: %d] %s\n", packagesRemaining, colorize(colorRed, r.err.Error()))
+			case statusSkipped:
+				verbosef("[Packages Remaining: %d] %s\n", packagesRemaining, colorize(colorYellow, r.skipMessage()))
+			default:
+				verbosef("[Packages Remaining: %d] %s\n", packagesRemaining, colorize(colorGreen, "Package vendorized "+r.path))
+			}
+		}
+	}
+	close(jobs)
+
+	if err := budgetExceeded(); err != nil {
+		fatalf("%s; stopped after vendorizing %d imports", err, len(copyRewrites()))
+	}
+	if isInterrupted() {
+		exitInterrupted(dest)
+	}
+
+	if len(keepReachable) > 0 {
+		for _, path := range keepReachable {
+			if !visited[path] {
+				infof("Warning: -keep-reachable-from package %s was never imported", path)
+			}
+		}
+		reachable := reachableFrom(keepReachable, false)
+		removed, err := pruneUnreachable(filepath.Join(gopath, "src", dest), reachable, "it isn't reachable from -keep-reachable-from")
+		if err != nil {
+			fatalf("Couldn't remove unreachable packages: %s", err)
+		}
+		infof("Removed %d packages not reachable from %s", removed, strings.Join(keepReachable, ", "))
+	}
+
+	if excludeTestOnly {
+		reachable := reachableFrom(roots, true)
+		removed, err := pruneUnreachable(filepath.Join(gopath, "src", dest), reachable, "only tests import it")
+		if err != nil {
+			fatalf("Couldn't remove test-only packages: %s", err)
+		}
+		infof("Removed %d packages only imported by tests", removed)
+	}
+
+	if minFanIn > 0 || maxFanIn > 0 {
+		// counted over every import seen, including those of packages removed above
+		removed, err := pruneUnreachable(filepath.Join(gopath, "src", dest), withinFanIn(), "its fan-in is out of range")
+		if err != nil {
+			fatalf("Couldn't remove packages by fan-in: %s", err)
+		}
+		infof("Removed %d packages not imported by %s packages", removed, fanInRange())
+	}
+
+	vendorFailures := failures
+	if updateRoot != "" {
+		if err := queueProjectFiles(updateRoot, dest); err != nil {
+			fatalf("Couldn't list the Go files of %q: %s", updateRoot, err)
+		}
+	}
+	if updateImports {
+		failures += rewriteAll()
+		if isInterrupted() {
+			exitInterrupted(dest)
+		}
+	}
+
+	atomic.StoreInt32(&summarizing, 1)
+	infof("Vendorized %d imports in %v", len(rewrites), time.Since(start))
+	reportCopied()
+	if failures > vendorFailures {
+		infof("%d packages vendorized, %d skipped, %d failed, %d failed to rewrite", succeeded, skipped, vendorFailures, failures-vendorFailures)
+	} else {
+		infof("%d packages vendorized, %d skipped, %d failed", succeeded, skipped, failures)
+	}
+	if warnDeprecated {
+		reportDeprecated()
+	}
+	reportMinGo()
+	reportLargeFiles()
+	reportDepth()
+	reportCached()
+	if rewriteSummary {
+		reportRewriteSummary()
+	}
+	if updateRoot != "" {
+		reportProject()
+	}
+	if flagCacheSource {
+		reportSources()
+	}
+	if verifyGofmt {
+		reportUnformatted()
+	}
+	reportBlacklistedImports()
+	reportPins()
+	reportAllowedGoroot()
+	if explain {
+		printExplanations()
+	}
+
+	// before anything is generated, as the generated files have no source and would be
+	// pruned, and so that the checksum manifest only lists what is kept
+	if mirror {
+		if failures > 0 {
+			errorf("Not pruning %q: %d packages failed to vendorize", dest, failures)
+		} else if err := prune(filepath.Join(gopath, "src", dest)); err != nil {
+			fatalf("Couldn't prune %q: %s", dest, err)
+		}
+	}
+
+	if reportLicenses || licenseCSV != "" {
+		infos := detectLicenses()
+		if reportLicenses {
+			printLicenseReport(infos)
+		}
+		if licenseCSV != "" {
+			if err := writeLicenseCSV(licenseCSV, infos); err != nil {
+				fatalf("Couldn't write license report to %q: %s", licenseCSV, err)
 			}
 		}
 	}
 
-	log.Printf("Vendorized %d imports in %v", len(rewrites), time.Since(start))
+	if stateFile != "" {
+		if err := saveState(stateFile, dest); err != nil {
+			fatalf("Couldn't write state to %q: %s", stateFile, err)
+		}
+	}
+
+	if graphFile != "" {
+		if err := writeGraph(graphFile); err != nil {
+			fatalf("Couldn't write graph to %q: %s", graphFile, err)
+		}
+	}
+
+	if vendorSpec != "" {
+		if err := writeVendorSpec(vendorSpec, pkgName); err != nil {
+			fatalf("Couldn't write vendor spec to %q: %s", vendorSpec, err)
+		}
+	}
+
+	if intoModule != "" {
+		if err := writeGoMod(intoModule, dest); err != nil {
+			fatalf("Couldn't write go.mod: %s", err)
+		}
+	}
+
+	if arch != nil && !dry {
+		if err := arch.Close(); err != nil {
+			fatalf("Couldn't write %q: %s", archive, err)
+		}
+	}
+
+	if reportDuplicates {
+		reportDupes(filepath.Join(gopath, "src", dest))
+	}
+
+	if checksumManifest != "" {
+		if err := writeManifest(checksumManifest, filepath.Join(gopath, "src", dest)); err != nil {
+			fatalf("Couldn't write checksum manifest: %s", err)
+		}
+		storeHashCache()
+	}
+
+	if planFile != "" {
+		if err := writePlan(planFile); err != nil {
+			fatalf("Couldn't write plan to %q: %s", planFile, err)
+		}
+	}
+
+	if reportUnusedPkgs {
+		if err := reportUnused(filepath.Join(gopath, "src", dest)); err != nil {
+			fatalf("Couldn't look for unused packages in %q: %s", dest, err)
+		}
+	}
+
+	if dumpTree {
+		if err := dumpDestTree(filepath.Join(gopath, "src", dest)); err != nil {
+			fatalf("Couldn't list %q: %s", dest, err)
+		}
+	}
+}
+
+// vendorize the package located at path, placing copied files in dest, and returns the result.
+// When pkgTimeout is set, a package that takes longer is reported as failed and abandoned. Its
+// work can't be interrupted, so it carries on in the background but its result is discarded,
+// imports included.
+func vendorize(path, dest string) vendorizeResult {
+	if pkgTimeout <= 0 {
+		return vendorizePackage(path, dest)
+	}
+
+	done := make(chan vendorizeResult, 1)
+	go func() {
+		done <- vendorizePackage(path, dest)
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-time.After(pkgTimeout):
+		return vendorizeResult{path: path, err: fmt.Errorf("Timed out vendorizing %s after %v", path, pkgTimeout), status: statusFailed}
+	}
 }
 
-// vendorize the package located at path, placing copied files in dest
-func vendorize(path, dest string, ch chan vendorizeResult) {
+// vendorizePackage does the work of vendorize, returning the result. The imports of the
+// package are returned with it, for the caller to queue, rather than vendorized here.
+// Every call gives exactly one result, which the caller counts the package off by; a
+// package without imports is copied all the same and just returns none to queue.
+func vendorizePackage(path, dest string) vendorizeResult {
+	defer trackActive()()
 
 	verbosef("Vendorizing %s", path)
 
 	result := vendorizeResult{path: path, err: nil}
 
-	if visited[path] {
-		result.err = fmt.Errorf("Path '%v' already visited... skipping", path)
-		ch <- result
-		return
+	if isVisited(path) {
+		result.status, result.skip = statusSkipped, skipVisited
+		return result
 	}
 
 	// build the package
 	rootPkg, err := buildPackage(path)
 	if err != nil {
 		result.err = fmt.Errorf("Couldn't import %s: %s", path, err)
-		ch <- result
-		return
+		result.status = statusFailed
+		return result
 	}
-	if rootPkg.Goroot {
+	if rootPkg.Goroot && !gorootAllowed(path) {
 		result.err = fmt.Errorf("Can't vendorize packages from GOROOT")
-		ch <- result
-		return
+		result.status = statusFailed
+		return result
+	}
+
+	if dumpImports {
+		logImports(rootPkg)
 	}
 
 	// get import statements
 	allImports := getAllImports(rootPkg)
 
+	nonTest := make(map[string]bool, len(rootPkg.Imports))
+	for _, imp := range rootPkg.Imports {
+		nonTest[imp] = true
+	}
+	if pluginPackages {
+		imports, constrainedNonTest, err := constrainedImports(rootPkg)
+		if err != nil {
+			result.err = fmt.Errorf("Couldn't read the imports of %s: %s", path, err)
+			result.status = statusFailed
+			return result
+		}
+		known := make(map[string]bool, len(allImports))
+		for _, imp := range allImports {
+			known[imp] = true
+		}
+		for _, imp := range imports {
+			if constrainedNonTest[imp] {
+				nonTest[imp] = true
+			}
+			if !known[imp] {
+				allImports = append(allImports, imp)
+			}
+		}
+	}
+
 	var pkgs []*build.Package
 	for _, imp := range allImports {
 		if imp == "C" {
 			continue
 		}
+		test := !nonTest[imp]
+		if orig, ok := priorVendored(imp); ok {
+			// vendorized into a previous destination; vendorize the original again
+			imp = orig
+		}
 		pkg, err := buildPackage(imp)
 		if err != nil {
 			result.err = fmt.Errorf("%s: couldn't import %s: %s", path, imp, err)
-			ch <- result
-			return
+			result.status = statusFailed
+			return result
+		}
+		if graphFile != "" || len(keepReachable) > 0 || excludeTestOnly || minFanIn > 0 || maxFanIn > 0 {
+			recordEdge(path, pkg.ImportPath, pkg.Goroot, test)
 		}
-		if !pkg.Goroot {
+		if !pkg.Goroot || gorootAllowed(pkg.ImportPath) {
 			pkgs = append(pkgs, pkg)
+		} else if explain {
+			recordGoroot(pkg.ImportPath)
 		}
 	}
 
-	// Recursively vendorize imports
+	// hand the imports back to be vendorized, even if this package goes on to be skipped
 	for _, pkg := range pkgs {
-		if pkg.ImportPath == path {
-			// Don't recurse into self.
-			continue
-		}
-		if !visited[pkg.ImportPath] {
-			packagesRemaining++
-			go vendorize(pkg.ImportPath, dest, ch)
+		if pkg.ImportPath != path {
+			result.imports = append(result.imports, pkg.ImportPath)
 		}
 	}
 
 	pkgDir := rootPkg.Dir
 
-	// only copy packages when they aren't ignored
 	if !ignored(path) {
-		newPath := dest + "/" + path
-		pkgDir = filepath.Join(gopath, "src", newPath)
+		if reason := filtered(rootPkg); reason != "" {
+			result.status, result.skip, result.why = statusSkipped, skipFiltered, reason
+			return result
+		}
+	}
+
+	// only copy packages when they aren't ignored
+	if why := whyIgnored(path); why != "" {
+		result.status, result.skip, result.why = statusSkipped, skipIgnored, why
+	} else {
+		newPath, err := vendoredPath(rootPkg, dest)
+		if err != nil {
+			result.err = err
+			result.status = statusFailed
+			return result
+		}
+		if link, linkPath := symlinkedDir(rootPkg); link != "" && !followSymlinks {
+			// the destination can't be canonical: it may be reached through the very link
+			linkDest, existed, err := linkPackage(filepath.Join(gopath, "src", newPath), rootPkg, link, linkPath)
+			if err != nil {
+				result.err = fmt.Errorf("Couldn't link %s: %s", path, err)
+				result.status = statusFailed
+				return result
+			}
+			if existed && !forceUpdates {
+				result.status, result.skip, result.why = statusSkipped, skipPreexisting, linkDest
+				return result
+			}
+			mu.Lock()
+			rewrites[path] = newPath
+			mu.Unlock()
+			if updateImports {
+				infof("Warning: not rewriting the imports of %s: it is linked to %q, and rewriting it would change the source", path, rootPkg.Dir)
+			}
+			return result
+		} else if link != "" {
+			verbosef("Copying %s from %q, where symbolic link %q points", path, rootPkg.Dir, link)
+		}
+		pkgDir = canonicalPath(filepath.Join(gopath, "src", newPath))
+		if pkgDir == rootPkg.Dir {
+			result.err = fmt.Errorf("Couldn't copy %s: source and destination are both %q", path, pkgDir)
+			result.status = statusFailed
+			return result
+		}
+		mu.Lock()
+		firstDir := destDirs[pkgDir]
+		destDirs[pkgDir] = rootPkg.Dir
+		mu.Unlock()
 		// only overwrite files if specifically requested to do so
-		fileExists, _ := exists(pkgDir)
-		if forceUpdates || !fileExists {
-			err = copyDir(pkgDir, rootPkg.Dir)
+		_, err = fsys.Stat(pkgDir)
+		if forceUpdates || err != nil || (preserveRepoLayout && repoCopied(rootPkg)) {
+			if err := checkPackageName(pkgDir, rootPkg, firstDir); err != nil {
+				result.err = fmt.Errorf("Couldn't copy %s: %s", path, err)
+				result.status = statusFailed
+				return result
+			}
+
+			verbosef("Vendorizing %s from %q to %q", path, rootPkg.Dir, pkgDir)
+			if preserveRepoLayout {
+				err = copyRepo(pkgDir, rootPkg, &result.metrics)
+			} else {
+				err = copyDir(pkgDir, rootPkg.Dir, excludedFiles(rootPkg), &result.metrics)
+				if err == nil && usesTestdata(rootPkg) {
+					err = copyTestdata(pkgDir, rootPkg, &result.metrics)
+				}
+			}
 			if err != nil {
 				result.err = fmt.Errorf("Couldn't copy %s: %s", path, err)
-				ch <- result
-				return
+				result.status = statusFailed
+				return result
 			}
+			mu.Lock()
 			rewrites[path] = newPath
+			mu.Unlock()
+			if warnDeprecated {
+				if err := checkDeprecated(rootPkg); err != nil {
+					verbosef("%s: couldn't read package doc: %s", path, err)
+				}
+			}
+			if foldsCase && !dry {
+				checkDiskCase(rootPkg, newPath)
+			}
+			if flagCacheSource {
+				result.metrics.source = packageSource(rootPkg)
+			}
+			if reportLicenses || licenseCSV != "" {
+				result.metrics.license = detectLicense(rootPkg)
+			}
+			if vendorSpec != "" {
+				root := repoRoot(rootPkg)
+				if result.metrics.rev = repoRevision(root); result.metrics.rev.Rev == "" {
+					infof("Warning: no revision found for %s in %q", path, root)
+				}
+			}
+			if rootPkg.Goroot {
+				checkGorootImports(rootPkg)
+			}
+			if minGoMinor > 0 {
+				if err := checkGoVersion(rootPkg); err != nil {
+					verbosef("%s: couldn't check the Go version it needs: %s", path, err)
+				}
+			}
 		} else {
-			result.err = fmt.Errorf("Ignored (preexisting): %q", pkgDir)
-			ch <- result
-			return
+			result.status, result.skip, result.why = statusSkipped, skipPreexisting, pkgDir
+			return result
 		}
 	}
 
-	// Rewrite any import lines in the package, but only on request
+	// Rewrite any import lines in the package, but only on request. The rewriting is
+	// done once every package has been vendorized, so that all of the rewrites are known.
 	if updateImports {
-		for _, files := range [][]string{
+		sets := [][]string{
 			rootPkg.GoFiles, rootPkg.CgoFiles, rootPkg.TestGoFiles, rootPkg.XTestGoFiles,
-		} {
+		}
+		if pluginPackages {
+			sets = append(sets, rootPkg.IgnoredGoFiles)
+		}
+		for _, files := range sets {
 			for _, file := range files {
-				if len(rewrites) > 0 {
-					destFile := filepath.Join(pkgDir, file)
-					verbosef("Rewriting imports in %q", destFile)
-					err := rewriteFile(destFile, filepath.Join(rootPkg.Dir, file), rewrites)
-					if err != nil {
-						result.err = fmt.Errorf("%s: couldn't rewrite file %q: %s", path, file, err)
-						ch <- result
-						return
-					}
+				if !rewriteTests && strings.HasSuffix(file, "_test.go") {
+					// copied with the upstream import paths they were written against
+					continue
+				}
+				src := filepath.Join(rootPkg.Dir, file)
+				if copyMode == copyModeMove {
+					// the source is gone, so rewrite the moved file in place
+					src = filepath.Join(pkgDir, file)
 				}
+				queueRewrite(path, filepath.Join(pkgDir, file), src)
 			}
 		}
+		files, err := textRewriteFiles(rootPkg.Dir)
+		if err != nil {
+			result.err = fmt.Errorf("Couldn't list the files of %s: %s", path, err)
+			result.status = statusFailed
+			return result
+		}
+		for _, file := range files {
+			src := filepath.Join(rootPkg.Dir, file)
+			if copyMode == copyModeMove {
+				src = filepath.Join(pkgDir, file)
+			}
+			queueTextRewrite(path, filepath.Join(pkgDir, file), src)
+		}
+		files, err = extRewriteFiles(rootPkg.Dir)
+		if err != nil {
+			result.err = fmt.Errorf("Couldn't list the files of %s: %s", path, err)
+			result.status = statusFailed
+			return result
+		}
+		for _, file := range files {
+			src := filepath.Join(rootPkg.Dir, file)
+			if copyMode == copyModeMove {
+				src = filepath.Join(pkgDir, file)
+			}
+			queueExtRewrite(path, filepath.Join(pkgDir, file), src)
+		}
 	}
 
-	ch <- result
-	return
+	return result
 }
 
 // checks for the existence of the file located at filepath
 func exists(filepath string) (bool, error) {
-	_, err := os.Stat(filepath)
+	_, err := fsys.Stat(filepath)
 	if os.IsNotExist(err) {
 		return false, nil
 	}
 	return err == nil, err
 }
 
+// reports whether the package at path has already been visited
+func isVisited(path string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return visited[path]
+}
+
+// returns a snapshot of the rewrites performed so far, including those of previous runs
+// read from the state file
+func copyRewrites() map[string]string {
+	mu.Lock()
+	defer mu.Unlock()
+	m := make(map[string]string, len(priorRewrites)+len(rewrites))
+	for k, v := range priorRewrites {
+		m[k] = v
+	}
+	for k, v := range rewrites {
+		m[k] = v
+	}
+	return m
+}
+
+// vendoredPath returns the import path pkg is copied to. With resolveVanity, the package's
+// canonical import comment is used in place of the path it was imported by. Packages listed
+// in the -dest-map file are copied where it says, paths matching a -rewrite-re pattern to
+// the rewritten path, and all others under dest with trimPath stripped and destSuffix
+// appended. It fails if the result collides with another package.
+func vendoredPath(pkg *build.Package, dest string) (string, error) {
+	path := pkg.ImportPath
+	if pkg.ImportComment != "" && pkg.ImportComment != path {
+		if resolveVanity {
+			verbosef("Vendorizing %s at its canonical import path %q", path, pkg.ImportComment)
+			path = pkg.ImportComment
+		} else {
+			infof("Warning: %s declares the canonical import path %q", path, pkg.ImportComment)
+		}
+	}
+	newPath, ok := destMap[pkg.ImportPath]
+	if !ok {
+		var err error
+		if newPath, ok, err = patternRewrite(path); err != nil {
+			return "", err
+		}
+	}
+	if !ok {
+		trimmedPath, err := trimImportPath(path)
+		if err != nil {
+			return "", err
+		}
+		newPath = dest + "/" + trimmedPath
+		if flattenSingleFile && isSingleFile(pkg) {
+			newPath = dest + "/" + flattenDir + "/" + flattenedName(trimmedPath)
+		}
+		newPath += destSuffix
+	}
+
+	if problem := pathProblem(newPath); problem != "" {
+		infof("Warning: vendored path %q of %s may not work on every file system: %s", newPath, pkg.ImportPath, problem)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if other, ok := claimed[newPath]; ok && other.ImportPath != pkg.ImportPath {
+		return "", fmt.Errorf("Vendored path %q of %s collides with %s: package %s from %q and package %s from %q would share a directory",
+			newPath, pkg.ImportPath, other.ImportPath, pkg.Name, pkg.Dir, other.Name, other.Dir)
+	}
+	if err := claimFolded(newPath, pkg.ImportPath); err != nil {
+		return "", err
+	}
+	claimed[newPath] = pkg
+	return newPath, nil
+}
+
+// cleans dest into the import path prefix packages are vendorized under, refusing
+// destinations that would put them directly into $GOPATH/src
+func normalizeDest(dest string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(dest))
+	if cleaned == "." || cleaned == "/" {
+		return "", fmt.Errorf("%q would vendorize into the root of $GOPATH/src", dest)
+	}
+	if err := validImportPath(cleaned); err != nil {
+		return "", err
+	}
+	return cleaned, nil
+}
+
+// canonicalPath resolves any symlinks in path so that paths can be compared reliably.
+// Paths that don't exist yet are resolved through their nearest existing parent.
+func canonicalPath(path string) string {
+	if path == "" {
+		return path
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path
+	}
+	return filepath.Join(canonicalPath(parent), filepath.Base(path))
+}
+
 // determines if the path contains an ignored prefix
 func ignored(path string) bool {
+	return whyIgnored(path) != ""
+}
+
+// returns why the package at path isn't copied, or "" if it is to be
+func whyIgnored(path string) string {
+	mu.Lock()
 	_, rewritten := rewrites[path]
+	mu.Unlock()
 	if rewritten {
-		return true
+		return "it has already been vendorized"
+	}
+	if prefix, ok := blacklistedBy(path); ok {
+		return fmt.Sprintf("it is blacklisted by -b %s", prefix)
+	}
+	if hasPackagePrefix(path, vendorDest) {
+		return "it is in the destination"
 	}
 	for _, prefix := range blacklistedPrefixes {
-		if strings.HasPrefix(path, prefix) {
-			return true
+		if hasPackagePrefix(path, prefix) {
+			return "it is part of the package being vendorized"
+		}
+	}
+	return ""
+}
+
+// returns path with -trim-path stripped, if it is one of its elements or a parent of them.
+// A prefix ending partway through an element, like example.com/go for
+// example.com/gopher, leaves the path alone.
+func trimImportPath(path string) (string, error) {
+	prefix := strings.TrimSuffix(trimPath, "/")
+	if prefix == "" || path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return path, nil
+	}
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+	if trimmed == "" {
+		return "", fmt.Errorf("Trimming %q from %s leaves an empty import path", trimPath, path)
+	}
+	return trimmed, nil
+}
+
+// reports whether the import path path starts with prefix. Unless prefix ends in a
+// slash, it only matches whole elements, so example.com/go doesn't match
+// example.com/gopher. A major version suffix like /v2 right after the prefix makes for
+// a different module, so github.com/x/y doesn't match github.com/x/y/v2.
+func hasPackagePrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	rest := path[len(prefix):]
+	switch {
+	case rest == "" || prefix == "":
+		return true
+	case strings.HasPrefix(rest, "/"):
+		rest = rest[1:]
+	case !strings.HasSuffix(prefix, "/"):
+		return false
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest = rest[:i]
+	}
+	return !isMajorVersion(rest)
+}
+
+// reports whether elem is a major version suffix of a module path, like v2
+func isMajorVersion(elem string) bool {
+	if len(elem) < 2 || elem[0] != 'v' || elem[1] == '0' || elem == "v1" {
+		return false
+	}
+	for _, r := range elem[1:] {
+		if r < '0' || r > '9' {
+			return false
 		}
 	}
-	return false
+	return true
 }
 
-// copyFile copies the file given by src to dest, creating dest with the permissions given by perm.
+// copyFile puts the file given by src at dest as -copy-mode says, creating copies with the
+// permissions given by perm.
 func copyFile(dest, src string, perm os.FileMode) error {
-	in, err := os.Open(src)
+	switch copyMode {
+	case copyModeMove:
+		return moveFile(dest, src, perm)
+	case copyModeSymlink, copyModeHardlink:
+		return linkFile(dest, src, perm)
+	}
+	return copyData(dest, src, perm)
+}
+
+// copies the content of the file given by src to dest, creating dest with the permissions
+// given by perm
+func copyData(dest, src string, perm os.FileMode) error {
+	in, err := fsys.Open(src)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
-	out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
-	if err != nil {
+	r := normalizeLineEndings(in)
+	if !reportDuplicates && checksumManifest == "" {
+		return writeFile(dest, r, perm)
+	}
+
+	h := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, h)}
+	if err := writeFile(dest, counter, perm); err != nil {
 		return err
 	}
-	defer out.Close()
+	if reportDuplicates {
+		recordContent(h.Sum(nil), counter.n, dest)
+	}
+	if checksumManifest != "" {
+		recordSum(dest, h.Sum(nil))
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// returns the names of the files in pkg that shouldn't be copied
+func excludedFiles(pkg *build.Package) map[string]bool {
+	exclude := make(map[string]bool)
+	if noIgnoredFiles {
+		for _, files := range [][]string{pkg.IgnoredGoFiles, pkg.IgnoredOtherFiles} {
+			for _, file := range files {
+				exclude[file] = true
+			}
+		}
+	}
+	return exclude
+}
 
-	_, err = io.Copy(out, in)
+// copyDir non-recursively copies the contents of the src directory to dest, skipping the
+// files named in exclude, and counts the files copied in m.
+func copyDir(dest, src string, exclude map[string]bool, m *packageMetrics) error {
+	return copyContents(dest, src, exclude, false, m)
+}
 
-	return err
+// copyTree recursively copies the contents of the src directory to dest, skipping version
+// control metadata and the files named, relative to src, in exclude, and counts the files
+// copied in m.
+func copyTree(dest, src string, exclude map[string]bool, m *packageMetrics) error {
+	return copyContents(dest, src, exclude, true, m)
 }
 
-// copyDir non-recursively copies the contents of the src directory to dest.
-func copyDir(dest, src string) error {
+// copies the contents of the src directory to dest, recursing into subdirectories if asked
+// to, and counts the files copied in m
+func copyContents(dest, src string, exclude map[string]bool, recursive bool, m *packageMetrics) error {
 	verbosef("Copying contents of %q to %q", src, dest)
+	planned("mkdir", dest, "")
 	if !dry {
-		err := os.MkdirAll(dest, 0770)
+		err := fsys.MkdirAll(dest, 0770)
 		if err != nil {
 			return fmt.Errorf("Couldn't make destination directory %v", dest)
 		}
 	}
 
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	return fsys.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// We don't recurse.
 		if info.IsDir() {
-			if path != src {
+			if path == src {
+				return nil
+			}
+			if !recursive || vcsDirs[info.Name()] {
 				return filepath.SkipDir
 			}
-			return nil
+			if skippedHidden(info.Name()) {
+				verbosef("Skipping hidden directory %q", path)
+				return filepath.SkipDir
+			}
+			relPath, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			destDir := filepath.Join(dest, relPath)
+			mu.Lock()
+			destDirs[destDir] = path
+			mu.Unlock()
+			planned("mkdir", destDir, "")
+			if dry {
+				return nil
+			}
+			return fsys.MkdirAll(destDir, 0770)
 		}
 
 		relPath, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
 		}
+		if exclude[relPath] {
+			verbosef("Excluding %q", path)
+			return nil
+		}
+		if skippedHidden(info.Name()) {
+			verbosef("Skipping hidden file %q", path)
+			return nil
+		}
 		destFile := filepath.Join(dest, relPath)
+
+		destInfo, err := fsys.Stat(destFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if !forceUpdates {
+				return nil
+			}
+			if noOverwriteNewer && destInfo.ModTime().After(info.ModTime()) {
+				infof("Skipping %q: it is newer than %q", destFile, path)
+				return nil
+			}
+			if err := handleConflict(destFile, path); err != nil {
+				return err
+			}
+		}
+
+		checkPathLen(destFile)
+		checkLargeFile(path, info.Size())
+		if err := chargeBudget(info.Size()); err != nil {
+			return err
+		}
 		verbosef("Copying %q to %q", path, destFile)
+		planned("copy", destFile, path)
 		if dry {
+			m.files++
+			m.bytes += info.Size()
 			return nil
 		}
-
-		doesExist, err := exists(destFile)
-
-		if err != nil {
+		if err := copyFile(destFile, path, destPerm(info.Mode().Perm())); err != nil {
 			return err
 		}
+		m.files++
+		m.bytes += info.Size()
+		return keepModTime(destFile, info)
+	})
+}
 
-		if !doesExist || forceUpdates {
-			copyFile(destFile, path, info.Mode().Perm())
+// maxNameLen is the longest file name most filesystems accept.
+const maxNameLen = 255
+
+// warns about destination paths that are likely to fail with "file name too long"
+func checkPathLen(path string) {
+	if maxPathLen > 0 && len(path) > maxPathLen {
+		infof("Warning: %q is %d characters long, over the -max-path-len limit of %d", path, len(path), maxPathLen)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if len(elem) > maxNameLen {
+			infof("Warning: %q has a path element of %d characters, over the usual limit of %d", path, len(elem), maxNameLen)
+			return
 		}
+	}
+}
 
+// gives dest the modification time of src when -no-overwrite-newer is set, so that only
+// local edits make a destination file newer than its source
+func keepModTime(dest string, src os.FileInfo) error {
+	if !noOverwriteNewer {
 		return nil
-	})
+	}
+	return fsys.Chtimes(dest, src.ModTime())
 }
 
-// returns a list of all import paths in the Go files of pkg.
+// returns a list of all import paths in the Go files of pkg. With prodOnly, the imports
+// of test files are left out. Blank imports, made only for the side effects of a package,
+// like registering a database driver, are listed by go/build like any other and so are
+// followed, and recorded in the graph, as required imports.
 func getAllImports(pkg *build.Package) []string {
 	allImports := make(map[string]bool)
-	for _, imports := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+	sets := [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports}
+	if prodOnly {
+		sets = sets[:1]
+	}
+	for _, imports := range sets {
 		for _, imp := range imports {
 			allImports[imp] = true
 		}
@@ -318,67 +1568,285 @@ func getAllImports(pkg *build.Package) []string {
 	return result
 }
 
+// logs the three import lists of pkg that getAllImports unions, apart, so that the import
+// that brought in a dependency can be told from the others
+func logImports(pkg *build.Package) {
+	lines := []string{fmt.Sprintf("Imports of %s from %q:", pkg.ImportPath, pkg.Dir)}
+	for _, list := range []struct {
+		name    string
+		imports []string
+	}{
+		{"imports", pkg.Imports},
+		{"test imports", pkg.TestImports},
+		{"xtest imports", pkg.XTestImports},
+	} {
+		imports := "(none)"
+		if len(list.imports) > 0 {
+			imports = strings.Join(list.imports, " ")
+		}
+		lines = append(lines, fmt.Sprintf("  %-14s %s", list.name+":", imports))
+	}
+	// a single call, so the lines of packages vendorized concurrently don't interleave
+	infof("%s", strings.Join(lines, "\n"))
+}
+
 // buildPackage builds a package given by the path.
 func buildPackage(path string) (*build.Package, error) {
+	mu.Lock()
 	if builtPackages == nil {
 		builtPackages = make(map[string]*build.Package)
 	}
-	if pkg, ok := builtPackages[path]; ok {
-		return pkg, nil
+	cached, ok := builtPackages[path]
+	mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+	if golistPackages != nil {
+		return goListPackageAt(path)
 	}
 
 	ctx := build.Default
+	ctx.GOOS = goEnv("GOOS")
+	ctx.GOARCH = goEnv("GOARCH")
+	ctx.BuildTags = splitBuildTags()
+	ctx.GOROOT = canonicalPath(goEnv("GOROOT"))
+	ctx.GOPATH = resolveGOPATH()
+	if !readsOS(fsys) {
+		// go/build only resolves modules itself when these are left unset
+		ctx.OpenFile = func(path string) (io.ReadCloser, error) { return fsys.Open(path) }
+		ctx.ReadDir = readDir
+		ctx.IsDir = func(path string) bool {
+			info, err := fsys.Stat(path)
+			return err == nil && info.IsDir()
+		}
+	}
 
-	pkg, err := ctx.Import(path, "", 0)
+	pkg, err := importPackage(ctx, path)
+	if _, ok := err.(*build.NoGoError); ok && !ctx.CgoEnabled {
+		// a package made up only of cgo files has no Go files with cgo disabled, but is
+		// vendorized all the same, for the platforms that build it
+		ctx.CgoEnabled = true
+		if cgoPkg, cgoErr := importPackage(ctx, path); cgoErr == nil && len(cgoPkg.CgoFiles) > 0 {
+			verbosef("%s is made up only of cgo files, which cgo is disabled for", path)
+			pkg, err = cgoPkg, nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	pkg.Dir = canonicalPath(pkg.Dir)
+	if !pkg.Goroot {
+		if entries := gopathEntries(path); len(entries) > 1 {
+			infof("Warning: %s is in several GOPATH entries; using %q and ignoring %s",
+				path, entries[0], strings.Join(entries[1:], ", "))
+		}
+	}
+	mu.Lock()
 	builtPackages[path] = pkg
+	mu.Unlock()
 	return pkg, nil
 }
 
-// rewrites the file at path with new import statements
-func rewriteFile(dest, path string, m map[string]string) error {
+// imports the package at path with ctx, resolving it to its go.mod replacement, if any
+func importPackage(ctx build.Context, path string) (*build.Package, error) {
+	target, dir, ok := replacedImport(path)
+	if !ok {
+		return ctx.Import(path, "", build.ImportComment)
+	}
+	// resolve the replacement, but keep the import path it is vendorized under
+	verbosef("Resolving %s to %s per go.mod replace", path, target)
+	var pkg *build.Package
+	var err error
+	if dir {
+		pkg, err = ctx.ImportDir(target, build.ImportComment)
+	} else {
+		pkg, err = ctx.Import(target, "", build.ImportComment)
+	}
+	if pkg != nil {
+		pkg.ImportPath = path
+	}
+	return pkg, err
+}
+
+// rewrites the file at path with new import statements, returning how many of them were
+// rewritten. Unless newPath is empty, a canonical import comment is rewritten to it.
+func rewriteFile(dest, path, newPath string, m map[string]string) (int, error) {
+	var rewritten int
+	err := rewriteWith(dest, path, func(buf *bytes.Buffer) (bool, error) {
+		n, changed, err := rewriteFileImports(path, newPath, m, buf)
+		if changed && verifyGofmt {
+			checkGofmt(dest, buf.Bytes())
+		}
+		rewritten = n
+		return changed, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rewritten, nil
+}
+
+// replaces dest with what render makes of the file at path, leaving dest alone when
+// render reports that nothing changed
+func rewriteWith(dest, path string, render func(buf *bytes.Buffer) (bool, error)) error {
+	planned("rewrite", dest, "")
 	if dry {
+		if rewriteSummary {
+			// rendered for nothing, so that -rewrite-dry-summary counts what would change
+			var buf bytes.Buffer
+			if _, err := render(&buf); err != nil {
+				verbosef("Couldn't count the rewrites of %q: %s", dest, err)
+			}
+		}
 		return nil
 	}
 
-	f, err := ioutil.TempFile("", "vendorize")
+	info, err := fsys.Stat(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	err = rewriteFileImports(path, m, f)
+	if noOverwriteNewer {
+		destInfo, err := fsys.Stat(dest)
+		if err == nil && destInfo.ModTime().After(info.ModTime()) {
+			infof("Not rewriting %q: it is newer than %q", dest, path)
+			return nil
+		}
+	}
+
+	var buf bytes.Buffer
+	changed, err := render(&buf)
 	if err != nil {
 		return err
 	}
-	return os.Rename(f.Name(), dest)
+	if !changed {
+		verbosef("Leaving %q as is: none of its imports are rewritten", dest)
+		return nil
+	}
+
+	perm := info.Mode().Perm()
+	if dest != path {
+		// the files of packages that aren't vendorized are rewritten where they are
+		perm = destPerm(perm)
+	}
+	h := sha256.New()
+	err = replaceFile(dest, perm, func(w io.Writer) error {
+		_, err := io.MultiWriter(w, h).Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if checksumManifest != "" {
+		recordSum(dest, h.Sum(nil))
+	}
+	if postRewriteHook != "" {
+		queueHook(dest, info)
+	}
+	return keepModTime(dest, info)
 }
 
-// rewrites the file import statements to the new location
-func rewriteFileImports(path string, m map[string]string, w io.Writer) error {
+// rewrites the file import statements to the new location.
+// Comments are parsed and printed at their original positions, so the cgo preamble
+// immediately preceding an import "C" is preserved byte for byte. "C" itself is
+// never in m and is left alone. Unless newPath is empty, a canonical import comment is
+// rewritten to it. The number of import statements rewritten is returned, along with
+// whether the file changed at all. Nothing is written, and false returned, when neither
+// the imports nor the import comment of the file are rewritten, so that it isn't
+// reprinted for nothing.
+func rewriteFileImports(path, newPath string, m map[string]string, w io.Writer) (int, bool, error) {
+	src, err := readFile(path)
+	if err != nil {
+		return 0, false, err
+	}
 	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	f, err := parser.ParseFile(fset, path, src, parser.ParseComments)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 
+	rewritten := 0
+	origs := make(map[*ast.ImportSpec]string) // the original paths of the rewritten imports
 	for _, s := range f.Imports {
 		path, err := strconv.Unquote(s.Path.Value)
 		if err != nil {
 			panic(err)
 		}
+		if strings.HasPrefix(path, vendorDest+"/") {
+			// already rewritten by an earlier run
+			continue
+		}
+		if orig, ok := priorVendored(path); ok {
+			path = orig
+		}
 		if replacement, ok := m[path]; ok {
 			s.Path.Value = strconv.Quote(replacement)
+			origs[s] = path
+			rewritten++
+			continue
+		}
+		replacement, ok, err := patternRewrite(path)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok && vendoredAt(path, replacement) {
+			s.Path.Value = strconv.Quote(replacement)
+			origs[s] = path
+			rewritten++
 		}
 	}
+	if normalizeImports && rewritten > 0 {
+		normalizeAliases(path, f, origs)
+	}
+
+	changed := rewritten > 0
+	if newPath != "" && rewriteImportComment(fset, f, newPath) {
+		changed = true
+	}
+
+	if !changed {
+		return 0, false, nil
+	}
+
+	if sortImports {
+		ast.SortImports(fset, f)
+	}
 
-	return printer.Fprint(w, fset, f)
+	if gofmtOutput {
+		return rewritten, true, format.Node(w, fset, f)
+	}
+	return rewritten, true, printer.Fprint(w, fset, f)
 }
 
-// verbosef logs only if verbose is true.
+// summarizing is set once the run gets to its summary, which -summary-only logs. It is
+// read atomically, as packages abandoned by -pkg-timeout may still be logging.
+var summarizing int32
+
+// reports whether informational output is suppressed: with quiet, or with summaryOnly
+// before the summary
+func silenced() bool {
+	return quiet || summaryOnly && atomic.LoadInt32(&summarizing) == 0
+}
+
+// verbosef logs only if verbose is true and the output isn't silenced.
 func verbosef(s string, args ...interface{}) {
-	if verbose {
+	if verbose && !silenced() {
+		log.Printf(s, args...)
+	}
+}
+
+// infof logs unless the output is silenced, by quiet or by summaryOnly.
+func infof(s string, args ...interface{}) {
+	if !silenced() {
 		log.Printf(s, args...)
 	}
 }
+
+// outputf writes data to stdout, keeping it apart from the logs on stderr.
+func outputf(s string, args ...interface{}) {
+	fmt.Fprintf(os.Stdout, s, args...)
+}
+
+// errorf always logs, even if quiet is true.
+func errorf(s string, args ...interface{}) {
+	log.Printf(s, args...)
+}
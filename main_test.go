@@ -0,0 +1,1821 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// makes a GOPATH in a temporary directory holding files, keyed by their paths relative
+// to the GOPATH, and points vendorize at it. The returned function removes it.
+func setupGOPATH(t testing.TB, files map[string]string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = canonicalPath(dir)
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goEnvOnce.Do(func() {})
+	goEnvValues = map[string]string{
+		"GOPATH": dir,
+		"GOROOT": build.Default.GOROOT,
+		"GOOS":   runtime.GOOS,
+		"GOARCH": runtime.GOARCH,
+	}
+	gopath = dir
+	builtPackages = nil
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mainEnv is set in the environment of the test binary when it is run as vendorize by
+// runVendorize.
+const mainEnv = "VENDORIZE_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runs vendorize with args in a separate process, for the flags only main wires up, with
+// GOPATH set to gopath and env added to the environment. It returns what was logged and
+// printed.
+func runVendorize(t testing.TB, gopath string, env []string, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = gopath
+	cmd.Env = append(os.Environ(), mainEnv+"=1", "GO111MODULE=off", "GOFLAGS=", "GOPATH="+gopath)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestBuildPackageCgo(t *testing.T) {
+	_, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/dep/dep.go":        "package dep\n\nvar X = 1\n",
+		"src/example.com/cgoonly/c.go":      "package cgoonly\n\n// #include <stdlib.h>\nimport \"C\"\n\nimport \"example.com/dep\"\n\nvar _ = dep.X\n",
+		"src/example.com/fallback/cgo.go":   "package fallback\n\n// #include <stdlib.h>\nimport \"C\"\n",
+		"src/example.com/fallback/nocgo.go": "//go:build !cgo\n\npackage fallback\n\nimport \"example.com/dep\"\n\nvar _ = dep.X\n",
+	})
+	defer cleanup()
+	defer func(enabled bool) { build.Default.CgoEnabled = enabled }(build.Default.CgoEnabled)
+
+	tests := []struct {
+		cgo        bool
+		path       string
+		cgoFiles   []string
+		importsDep bool
+	}{
+		// a package made up only of cgo files is vendorized, imports and all, either way
+		{true, "example.com/cgoonly", []string{"c.go"}, true},
+		{false, "example.com/cgoonly", []string{"c.go"}, true},
+		// files only built without cgo are followed when cgo is disabled, as the go tool would
+		{true, "example.com/fallback", []string{"cgo.go"}, false},
+		{false, "example.com/fallback", nil, true},
+	}
+	for _, test := range tests {
+		build.Default.CgoEnabled = test.cgo
+		builtPackages = nil
+		pkg, err := buildPackage(test.path)
+		if err != nil {
+			t.Errorf("cgo=%v: buildPackage(%s): %s", test.cgo, test.path, err)
+			continue
+		}
+		if len(pkg.CgoFiles) != len(test.cgoFiles) || len(test.cgoFiles) > 0 && pkg.CgoFiles[0] != test.cgoFiles[0] {
+			t.Errorf("cgo=%v: %s has cgo files %v, want %v", test.cgo, test.path, pkg.CgoFiles, test.cgoFiles)
+		}
+		if got := contains(getAllImports(pkg), "example.com/dep"); got != test.importsDep {
+			t.Errorf("cgo=%v: %s imports example.com/dep: %v, want %v", test.cgo, test.path, got, test.importsDep)
+		}
+	}
+}
+
+func TestCheckOnConflict(t *testing.T) {
+	defer func(f, m bool, o, c string) { forceUpdates, mirror, only, onConflict = f, m, o, c }(forceUpdates, mirror, only, onConflict)
+	tests := []struct {
+		force, mirror bool
+		only          string
+		policy        string
+		want          string // the policy checked, or "" for an error
+	}{
+		{false, false, "", "", conflictSkip},
+		{true, false, "", "", conflictOverwrite},
+		{false, true, "", "", conflictOverwrite},
+		{false, false, "example.com/x", "", conflictOverwrite},
+		{true, false, "", conflictSkip, ""},
+		{false, true, "", conflictSkip, ""},
+		{false, false, "example.com/x", conflictSkip, ""},
+		{false, true, "", conflictBackup, conflictBackup},
+		{false, false, "", "sometimes", ""},
+	}
+	for _, test := range tests {
+		forceUpdates, mirror, only, onConflict = test.force, test.mirror, test.only, test.policy
+		// as main does before checking the policy
+		if mirror || only != "" {
+			forceUpdates = true
+		}
+		err := checkOnConflict()
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("-f=%v -mirror=%v -only=%q -on-conflict %q: no error, chose %q", test.force, test.mirror, test.only, test.policy, onConflict)
+		case test.want != "" && err != nil:
+			t.Errorf("-f=%v -mirror=%v -only=%q -on-conflict %q: %s", test.force, test.mirror, test.only, test.policy, err)
+		case test.want != "" && onConflict != test.want:
+			t.Errorf("-f=%v -mirror=%v -only=%q -on-conflict %q: chose %q, want %q", test.force, test.mirror, test.only, test.policy, onConflict, test.want)
+		}
+	}
+}
+
+func TestHashCacheRewriteKeepingModTime(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{"f.go": "package a\n"})
+	defer cleanup()
+	defer func(d time.Duration) { racyInterval = d }(racyInterval)
+	racyInterval = -time.Hour // cache freshly written files too
+	hashCache = make(map[string]hashEntry)
+	defer func() { hashCache = nil }()
+
+	path := filepath.Join(dir, "f.go")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := cachedFileSum(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hashCache[path]; !ok {
+		t.Fatal("sum wasn't cached")
+	}
+
+	// rewritten to the same size, with the modification time set back like keepModTime does
+	time.Sleep(10 * time.Millisecond)
+	if err := ioutil.WriteFile(path, []byte("package b\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, time.Now(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := cachedFileSum(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := fileSum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(after, before) || !bytes.Equal(after, want) {
+		t.Errorf("sum after the rewrite is %x, want %x", after, want)
+	}
+}
+
+func TestCheckGoVersion(t *testing.T) {
+	_, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/plain/a.go":      "package plain\n",
+		"src/example.com/fallback/new.go": "//go:build go1.21\n\npackage fallback\n",
+		"src/example.com/fallback/old.go": "//go:build !go1.21\n\npackage fallback\n",
+		"src/example.com/newonly/new.go":  "//go:build go1.21\n\npackage newonly\n",
+	})
+	defer cleanup()
+	defer func(s string, m int) { minGo, minGoMinor = s, m }(minGo, minGoMinor)
+	minGo, minGoMinor = "go1.16", 16
+
+	tests := []struct {
+		path    string
+		flagged bool
+	}{
+		{"example.com/plain", false},
+		{"example.com/fallback", false},
+		{"example.com/newonly", true},
+	}
+	for _, test := range tests {
+		pkg, err := buildPackage(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newerGo = make(map[string]string)
+		if err := checkGoVersion(pkg); err != nil {
+			t.Fatal(err)
+		}
+		if why, flagged := newerGo[test.path]; flagged != test.flagged {
+			t.Errorf("%s flagged as needing a newer Go than %s: %v (%s), want %v", test.path, minGo, flagged, why, test.flagged)
+		}
+	}
+}
+
+func TestTrimImportPath(t *testing.T) {
+	defer func(p string) { trimPath = p }(trimPath)
+	tests := []struct {
+		trim, path, want string
+		err              bool
+	}{
+		{"", "example.com/go/x", "example.com/go/x", false},
+		{"example.com/go", "example.com/go/x", "x", false},
+		{"example.com/go/", "example.com/go/x/y", "x/y", false},
+		{"example.com/go", "example.com/gopher/x", "example.com/gopher/x", false},
+		{"example.com/go", "other.com/example.com/go/x", "other.com/example.com/go/x", false},
+		{"example.com/go", "example.com/go", "", true},
+	}
+	for _, test := range tests {
+		trimPath = test.trim
+		got, err := trimImportPath(test.path)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("-trim-path %q: trimImportPath(%q) = %q, %v; want %q, error %v", test.trim, test.path, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestReadsOS(t *testing.T) {
+	tests := []struct {
+		name string
+		fs   FileSystem
+		want bool
+	}{
+		{"osFS", osFS{}, true},
+		{"serialFS over osFS", &serialFS{fs: osFS{}}, true},
+		{"memFS", newMemFS(), false},
+		{"serialFS over memFS", &serialFS{fs: newMemFS()}, false},
+	}
+	for _, test := range tests {
+		if got := readsOS(test.fs); got != test.want {
+			t.Errorf("readsOS(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRewriteKeepsCgoPreamble(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/c/c.go": `package c
+
+/*
+#cgo CFLAGS:   -DX=1   -O2
+#include <stdlib.h>
+
+	static int twice(int x) { return 2*x; }   // trailing comment
+*/
+import "C"
+
+import "example.com/dep"
+
+var _ = dep.X
+`,
+	})
+	defer cleanup()
+	path := filepath.Join(dir, "src", "example.com", "c", "c.go")
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preamble := src[bytes.Index(src, []byte("/*")) : bytes.Index(src, []byte("*/"))+2]
+
+	var buf bytes.Buffer
+	n, changed, err := rewriteFileImports(path, "", map[string]string{"example.com/dep": "example.com/v/example.com/dep"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !changed {
+		t.Fatalf("rewrote %d imports, changed %v; want 1, true", n, changed)
+	}
+	out := buf.Bytes()
+	if !bytes.Contains(out, append(append([]byte(nil), preamble...), "\nimport \"C\""...)) {
+		t.Errorf("preamble changed; got:\n%s", out)
+	}
+	if !bytes.Contains(out, []byte(`"example.com/v/example.com/dep"`)) {
+		t.Errorf("import not rewritten; got:\n%s", out)
+	}
+}
+
+func TestNormalizeDest(t *testing.T) {
+	tests := []struct {
+		dest, want string
+		err        bool
+	}{
+		{"github.com/p/app/_vendor/src", "github.com/p/app/_vendor/src", false},
+		{"github.com/p/app/_vendor/src/", "github.com/p/app/_vendor/src", false},
+		{"github.com//p/./app/x/../vendor", "github.com/p/app/vendor", false},
+		{"", "", true},
+		{".", "", true},
+		{"./", "", true},
+		{"/", "", true},
+		{"//", "", true},
+		{"a/..", "", true},
+		{"..", "", true},
+		{"../x", "", true},
+		{"/abs/dest", "", true},
+		{"a b/c", "", true},
+	}
+	for _, test := range tests {
+		got, err := normalizeDest(test.dest)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("normalizeDest(%q) = %q, %v; want %q, error %v", test.dest, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestRewriteTwice(t *testing.T) {
+	const src = "package a\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/dep\"\n)\n\nvar _ = fmt.Sprint(dep.X)\n"
+	tests := []struct {
+		name    string
+		prior   string // destination of the previous run, if it differs
+		want    string
+		changed bool // whether the second pass changes the file
+	}{
+		{"same destination", "", "example.com/v/example.com/dep", false},
+		{"moved destination", "example.com/old", "example.com/v/example.com/dep", true},
+	}
+	defer func(d string, o map[string]string) { vendorDest, priorOrigins = d, o }(vendorDest, priorOrigins)
+	for _, test := range tests {
+		dir, cleanup := setupGOPATH(t, map[string]string{"a.go": src})
+		path := filepath.Join(dir, "a.go")
+		priorOrigins = make(map[string]string)
+
+		first := map[string]string{"example.com/dep": "example.com/v/example.com/dep"}
+		vendorDest = "example.com/v"
+		if test.prior != "" {
+			first = map[string]string{"example.com/dep": test.prior + "/example.com/dep"}
+			vendorDest = test.prior
+		}
+		if _, err := rewriteFile(path, path, "", first); err != nil {
+			t.Fatal(err)
+		}
+		once, _ := ioutil.ReadFile(path)
+
+		// the second run, into example.com/v, as it would go with -state
+		vendorDest = "example.com/v"
+		if test.prior != "" {
+			priorOrigins[test.prior+"/example.com/dep"] = "example.com/dep"
+		}
+		second := map[string]string{"example.com/dep": "example.com/v/example.com/dep"}
+		n, err := rewriteFile(path, path, "", second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twice, _ := ioutil.ReadFile(path)
+		if (n > 0) != test.changed || bytes.Equal(once, twice) == test.changed {
+			t.Errorf("%s: second pass rewrote %d imports:\n%s\nthen\n%s", test.name, n, once, twice)
+		}
+		if !bytes.Contains(twice, []byte(strconv.Quote(test.want))) || bytes.Count(twice, []byte("example.com/dep\"")) != 1 {
+			t.Errorf("%s: got\n%s\nwant a single import of %s", test.name, twice, test.want)
+		}
+
+		// and a third pass is a no-op either way
+		if n, err := rewriteFile(path, path, "", second); err != nil || n != 0 {
+			t.Errorf("%s: third pass rewrote %d imports, %v", test.name, n, err)
+		}
+		cleanup()
+	}
+}
+
+func TestLocalReplace(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/app/go.mod":                   "module example.com/app\n\nreplace (\n\texample.com/lib => ../fork // patched\n\texample.com/lib/v2 v2.1.0 => ./third_party/lib\n)\n\nreplace example.com/mod => example.com/mod2 v1.0.0\n",
+		"src/example.com/app/third_party/lib/sub/s.go": "package sub\n",
+		"src/example.com/fork/l.go":                    "package lib\n",
+		"src/example.com/fork/sub/s.go":                "package sub\n",
+		"src/example.com/mod2/m.go":                    "package mod\n",
+	})
+	defer cleanup()
+	defer func(r []goModReplace) { goModReplaces = r }(goModReplaces)
+	goModReplaces = nil
+	if err := loadGoModReplaces(filepath.Join(dir, "src", "example.com", "app", "go.mod")); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(dir, "src")
+	tests := []struct {
+		path, dir string
+	}{
+		{"example.com/lib", filepath.Join(src, "example.com", "fork")},
+		{"example.com/lib/sub", filepath.Join(src, "example.com", "fork", "sub")},
+		{"example.com/lib/v2/sub", filepath.Join(src, "example.com", "app", "third_party", "lib", "sub")},
+		{"example.com/mod", filepath.Join(src, "example.com", "mod2")},
+		// only whole elements are replaced
+		{"example.com/library", ""},
+	}
+	for _, test := range tests {
+		pkg, err := buildPackage(test.path)
+		if test.dir == "" {
+			if err == nil {
+				t.Errorf("%s resolved to %q, want an error", test.path, pkg.Dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+			continue
+		}
+		if pkg.Dir != test.dir || pkg.ImportPath != test.path {
+			t.Errorf("%s resolved to %s in %q, want %s in %q", test.path, pkg.ImportPath, pkg.Dir, test.path, test.dir)
+		}
+	}
+}
+
+// crossDeviceFS is a FileSystem that can't rename, like when the paths are on different
+// devices.
+type crossDeviceFS struct {
+	FileSystem
+}
+
+func (crossDeviceFS) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+}
+
+func TestMoveFileAcrossDevices(t *testing.T) {
+	defer func(fs FileSystem) { fsys = fs }(fsys)
+	mem := newMemFS()
+	fsys = crossDeviceFS{mem}
+
+	src := filepath.Join(string(filepath.Separator), "src", "a", "a.go")
+	dest := filepath.Join(string(filepath.Separator), "vendor", "a", "a.go")
+	for _, dir := range []string{filepath.Dir(src), filepath.Dir(dest)} {
+		if err := mem.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := mem.Create(src, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "package a\n"
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveFile(dest, src, 0640); err != nil {
+		t.Fatalf("moveFile: %s", err)
+	}
+	if _, err := mem.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("%s is still there after the move: %v", src, err)
+	}
+	info, err := mem.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("%s has mode %v, want %v", dest, info.Mode().Perm(), os.FileMode(0640))
+	}
+	f, err = mem.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("%s holds %q, want %q", dest, got, content)
+	}
+}
+
+func TestRewriteNoOpLeavesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// not gofmt'd, so reprinting it would change it
+	src := "package a\n\nimport (\n\t\"fmt\"\n     \"example.com/other\"\n)\n\nvar _ = fmt.Sprint( other.X )\n"
+	path := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := rewriteFile(path, path, "", map[string]string{"example.com/dep": "example.com/v/example.com/dep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("rewrote %d imports, want 0", n)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != src {
+		t.Errorf("the file changed:\n%s\nwant:\n%s", got, src)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("the file was replaced")
+	}
+}
+
+func TestBlankImportsKept(t *testing.T) {
+	_, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/app/app.go":       "package app\n\nimport _ \"example.com/driver\"\n",
+		"src/example.com/app/app_test.go":  "package app\n\nimport _ \"example.com/testdep\"\n",
+		"src/example.com/driver/driver.go": "package driver\n",
+		"src/example.com/testdep/t.go":     "package testdep\n",
+	})
+	defer cleanup()
+	defer func(p bool, edges map[graphEdge]bool) { prodOnly, graphEdges = p, edges }(prodOnly, graphEdges)
+	graphEdges = make(map[graphEdge]bool)
+
+	pkg, err := buildPackage("example.com/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prod := range []bool{false, true} {
+		prodOnly = prod
+		if imports := getAllImports(pkg); !contains(imports, "example.com/driver") {
+			t.Errorf("with -prod-only=%v, the imports %v are missing the blank import", prod, imports)
+		}
+	}
+
+	nonTest := make(map[string]bool)
+	for _, imp := range pkg.Imports {
+		nonTest[imp] = true
+	}
+	prodOnly = false
+	for _, imp := range getAllImports(pkg) {
+		recordEdge(pkg.ImportPath, imp, false, !nonTest[imp])
+	}
+	reachable := reachableFrom([]string{"example.com/app"}, true)
+	if !reachable["example.com/driver"] {
+		t.Errorf("the blank import isn't reachable without tests: %v", reachable)
+	}
+	if reachable["example.com/testdep"] {
+		t.Errorf("the blank import of the tests is reachable without tests: %v", reachable)
+	}
+	if reachable := reachableFrom([]string{"example.com/app"}, false); !reachable["example.com/testdep"] {
+		t.Errorf("the blank import of the tests isn't reachable: %v", reachable)
+	}
+}
+
+func TestVendorizeLeafPackage(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/leaf/leaf.go": "package leaf\n",
+	})
+	defer cleanup()
+	defer func(vd string, r map[string]string, v map[string]bool, c map[string]*build.Package, d map[string]string) {
+		vendorDest, rewrites, visited, claimed, destDirs = vd, r, v, c, d
+	}(vendorDest, rewrites, visited, claimed, destDirs)
+	rewrites = make(map[string]string)
+	visited = make(map[string]bool)
+	claimed = make(map[string]*build.Package)
+	destDirs = make(map[string]string)
+
+	const dest = "example.com/app/_vendor/src"
+	vendorDest = dest
+	r := vendorizePackage("example.com/leaf", dest)
+	if r.status != statusVendorized || r.err != nil {
+		t.Fatalf("got status %v (%v, %s), want the package vendorized", r.status, r.err, r.skipMessage())
+	}
+	if len(r.imports) != 0 {
+		t.Errorf("got imports %v to queue, want none", r.imports)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src", dest, "example.com", "leaf", "leaf.go")); err != nil {
+		t.Errorf("the package wasn't copied: %s", err)
+	}
+
+	// as the run loop does with every result
+	visited[r.path] = true
+	if r := vendorizePackage("example.com/leaf", dest); r.status != statusSkipped || r.skip != skipVisited {
+		t.Errorf("got status %v (%s) the second time, want it skipped as visited", r.status, r.skip)
+	}
+}
+
+func TestMixedCaseOnMemFS(t *testing.T) {
+	defer func(fs FileSystem, q, folds bool, claims map[string]string) {
+		fsys, quiet, foldsCase, foldedClaims = fs, q, folds, claims
+	}(fsys, quiet, foldsCase, foldedClaims)
+	mem := newMemFS()
+	fsys = mem
+	quiet = true // the case collisions are warned about
+	src := filepath.Join(string(filepath.Separator), "gopath", "src")
+	for _, dir := range []string{"Example.org/Lib", "example.com/other", "example.com/Other"} {
+		if err := mem.MkdirAll(filepath.Join(src, filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// memFS keeps case, like most file systems
+	if caseInsensitive(filepath.Join(src, "Example.org")) {
+		t.Errorf("memFS is taken to ignore case")
+	}
+	if _, err := mem.Stat(filepath.Join(src, "example.org", "lib")); !os.IsNotExist(err) {
+		t.Errorf("a path cased differently was found: %v", err)
+	}
+
+	tests := []struct {
+		rel     string
+		dir     string
+		differs bool
+	}{
+		{"Example.org/Lib", "Example.org/Lib", false},
+		{"example.org/lib", "Example.org/Lib", true},
+		// an exact match wins over one differing only in case
+		{"example.com/other", "example.com/other", false},
+		{"example.com/Other", "example.com/Other", false},
+		{"example.com/missing", "", false},
+	}
+	for _, test := range tests {
+		dir, differs := diskCase(src, test.rel)
+		want := ""
+		if test.dir != "" {
+			want = filepath.Join(src, filepath.FromSlash(test.dir))
+		}
+		if dir != want || differs != test.differs {
+			t.Errorf("diskCase(%q) = %q, %v, want %q, %v", test.rel, dir, differs, want, test.differs)
+		}
+	}
+
+	for _, folds := range []bool{false, true} {
+		foldsCase, foldedClaims = folds, make(map[string]string)
+		if err := claimFolded("v/example.com/Lib", "example.com/Lib"); err != nil {
+			t.Fatal(err)
+		}
+		if err := claimFolded("v/example.com/Lib", "example.com/Lib"); err != nil {
+			t.Errorf("claiming the same path twice: %s", err)
+		}
+		err := claimFolded("v/example.com/lib", "example.com/lib")
+		if folds && err == nil {
+			t.Errorf("paths differing only in case were both claimed on a destination ignoring case")
+		} else if !folds && err != nil {
+			t.Errorf("paths differing only in case where case matters: %s", err)
+		}
+	}
+}
+
+func TestSkipUnparseable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(skip, q bool, r map[string]string, jobs []rewriteJob, counts map[string]*rewriteCount) {
+		skipUnparseable, quiet, rewrites, pendingRewrites, rewriteCounts = skip, q, r, jobs, counts
+	}(skipUnparseable, quiet, rewrites, pendingRewrites, rewriteCounts)
+	quiet = true
+
+	const (
+		good = "package a\n\nimport \"example.com/dep\"\n\nvar _ = dep.X\n"
+		bad  = "package a\n\nimport \"example.com/dep\"\n\nfunc {\n"
+	)
+	goodPath, badPath := filepath.Join(dir, "good.go"), filepath.Join(dir, "bad.go")
+	for _, skip := range []bool{false, true} {
+		for path, src := range map[string]string{goodPath: good, badPath: bad} {
+			if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		skipUnparseable = skip
+		rewrites = map[string]string{"example.com/dep": "example.com/v/example.com/dep"}
+		rewriteCounts = make(map[string]*rewriteCount)
+		pendingRewrites = []rewriteJob{
+			{pkg: "example.com/a", dest: badPath, src: badPath},
+			{pkg: "example.com/a", dest: goodPath, src: goodPath},
+		}
+
+		want := 1
+		if skip {
+			want = 0
+		}
+		if failed := rewriteAll(); failed != want {
+			t.Errorf("with -skip-unparseable=%v, %d packages failed, want %d", skip, failed, want)
+		}
+		if got, err := ioutil.ReadFile(badPath); err != nil || string(got) != bad {
+			t.Errorf("with -skip-unparseable=%v, the malformed file holds %q (%v), want it as is", skip, got, err)
+		}
+		got, err := ioutil.ReadFile(goodPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(got, []byte(`"example.com/v/example.com/dep"`)) {
+			t.Errorf("with -skip-unparseable=%v, the other file wasn't rewritten:\n%s", skip, got)
+		}
+	}
+}
+
+func TestHasPackagePrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b/c", "a/b", true},
+		{"a/bc", "a/b", false},
+		{"a/bc", "a/", true},
+		{"a/b", "a/b/", false},
+		{"a/b/c", "a/b/", true},
+		{"a/b", "", true},
+		{"b/c", "a/b", false},
+		{"github.com/x/y/v2", "github.com/x/y", false},
+		{"github.com/x/y/v2/z", "github.com/x/y", false},
+		{"github.com/x/y/vendor", "github.com/x/y", true},
+		{"github.com/x/y/v2", "github.com/x/", true},
+		{"github.com/x/y/v2", "github.com/x/y/", false},
+	}
+	for _, test := range tests {
+		if got := hasPackagePrefix(test.path, test.prefix); got != test.want {
+			t.Errorf("hasPackagePrefix(%q, %q) = %v, want %v", test.path, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestRewriteAllowed(t *testing.T) {
+	defer func(only stringSliceFlag) { rewriteOnly = only }(rewriteOnly)
+	rewriteOnly = stringSliceFlag{"a/b", "c/"}
+	for path, want := range map[string]bool{
+		"a/b":   true,
+		"a/b/c": true,
+		"a/bc":  false,
+		"c/d":   true,
+		"d":     false,
+	} {
+		if got := rewriteAllowed(path); got != want {
+			t.Errorf("rewriteAllowed(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	defer func(fs FileSystem) { fsys = fs }(fsys)
+	mem := newMemFS()
+	fsys = mem
+	root := filepath.Join(string(filepath.Separator), "gopath")
+	if err := mem.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(root, "file")
+	f, err := mem.Create(file, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := checkWritable(filepath.Join(root, "src", "example.com")); err != nil {
+		t.Errorf("a directory under an existing one: %s", err)
+	}
+	if err := checkWritable(filepath.Join(file, "src")); err == nil {
+		t.Errorf("a directory under a file is taken to be writable")
+	}
+	var left []string
+	mem.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && path != root && path != file {
+			left = append(left, path)
+		}
+		return nil
+	})
+	if len(left) > 0 {
+		t.Errorf("left behind %v", left)
+	}
+}
+
+func TestVendorSpecLeavesOutRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(q bool, r map[string]string, m map[string]packageMetrics) {
+		quiet, rewrites, vendoredMetrics = q, r, m
+	}(quiet, rewrites, vendoredMetrics)
+	quiet = true
+
+	rewrites = make(map[string]string)
+	vendoredMetrics = make(map[string]packageMetrics)
+	for _, path := range []string{"example.com/app", "example.com/app/sub", "example.com/dep", "example.com/application"} {
+		rewrites[path] = "example.com/app/_vendor/src/" + path
+		vendoredMetrics[path] = packageMetrics{rev: godep{Rev: "abc"}}
+	}
+
+	path := filepath.Join(dir, "Godeps.json")
+	if err := ioutil.WriteFile(path, []byte("stale\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeVendorSpec(path, "example.com/app"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec godeps
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	var deps []string
+	for _, dep := range spec.Deps {
+		deps = append(deps, dep.ImportPath)
+	}
+	if want := []string{"example.com/application", "example.com/dep"}; strings.Join(deps, " ") != strings.Join(want, " ") {
+		t.Errorf("got deps %v, want %v", deps, want)
+	}
+}
+
+func TestMirrorKeepsBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(f, m, q bool, c string, d map[string]string, b map[string]bool) {
+		forceUpdates, mirror, quiet, onConflict, destDirs, backups = f, m, q, c, d, b
+	}(forceUpdates, mirror, quiet, onConflict, destDirs, backups)
+	forceUpdates, mirror, quiet, onConflict = true, true, true, conflictBackup
+	destDirs, backups = make(map[string]string), make(map[string]bool)
+
+	src := filepath.Join(dir, "src", "example.com", "a")
+	root := filepath.Join(dir, "src", "v")
+	dest := filepath.Join(root, "example.com", "a")
+	for path, content := range map[string]string{
+		filepath.Join(src, "a.go"):    "package a\n",
+		filepath.Join(dest, "a.go"):   "package a // edited\n",
+		filepath.Join(dest, "old.go"): "package a\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// as vendorizePackage does for the package directory
+	destDirs[dest] = src
+	var m packageMetrics
+	if err := copyDir(dest, src, nil, &m); err != nil {
+		t.Fatal(err)
+	}
+	if err := prune(root); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dest, "a.go.bak")); err != nil || string(got) != "package a // edited\n" {
+		t.Errorf("the backup holds %q (%v), want the edited file", got, err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dest, "a.go")); err != nil || string(got) != "package a\n" {
+		t.Errorf("the copy holds %q (%v), want the source", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "old.go")); !os.IsNotExist(err) {
+		t.Errorf("the stale file wasn't pruned: %v", err)
+	}
+}
+
+func TestMirrorKeepsGeneratedFiles(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/app/main.go":      "package main\n\nimport _ \"example.com/dep\"\n\nfunc main() {}\n",
+		"src/example.com/dep/dep.go":       "package dep\n",
+		"src/example.com/v/stale/stale.go": "package stale\n",
+	})
+	defer cleanup()
+
+	root := filepath.Join(dir, "src", "example.com", "v")
+	out, err := runVendorize(t, dir, nil, "-mirror", "-into-module", "example.com/v",
+		"-vendor-spec", filepath.Join(root, "Godeps.json"), "-checksum-manifest", filepath.Join(root, "SUMS"),
+		"example.com/app", "example.com/v")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	for _, name := range []string{"go.mod", "Godeps.json", "SUMS", "example.com/dep/dep.go"} {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s is gone after the run: %s\n%s", name, err, out)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "stale")); !os.IsNotExist(err) {
+		t.Errorf("the stale package wasn't pruned: %v", err)
+	}
+	sums, err := ioutil.ReadFile(filepath.Join(root, "SUMS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sums, []byte("stale")) {
+		t.Errorf("the manifest lists the pruned package:\n%s", sums)
+	}
+}
+
+func TestPackageInTwoGOPATHEntries(t *testing.T) {
+	first, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/app/main.go": "package main\n\nimport _ \"example.com/dep\"\n\nfunc main() {}\n",
+		"src/example.com/dep/dep.go":  "package dep // first\n",
+	})
+	defer cleanup()
+	second, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/dep/dep.go": "package dep // second\n",
+	})
+	defer cleanup()
+
+	list := first + string(filepath.ListSeparator) + second
+	out, err := runVendorize(t, first, []string{"GOPATH=" + list}, "-v", "example.com/app", "example.com/app/_vendor/src")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	// copied into the entry holding the package rather than the last one, from the first
+	// entry holding the dependency
+	got, err := ioutil.ReadFile(filepath.Join(first, "src", "example.com", "app", "_vendor", "src", "example.com", "dep", "dep.go"))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if string(got) != "package dep // first\n" {
+		t.Errorf("copied %q, want the dependency in the first GOPATH entry", got)
+	}
+	if _, err := os.Stat(filepath.Join(second, "src", "example.com", "app")); !os.IsNotExist(err) {
+		t.Errorf("copied into the last GOPATH entry: %v", err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("Copying into %q, the GOPATH entry holding example.com/app", first),
+		fmt.Sprintf("Warning: example.com/dep is in several GOPATH entries; using %q and ignoring %s", first, second),
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the output doesn't say %q:\n%s", want, out)
+		}
+	}
+}
+
+// returns the files of a chain of n packages under example.com/chain, each importing the
+// next, and of example.com/app importing the first
+func chainFiles(n int) map[string]string {
+	files := map[string]string{
+		"src/example.com/app/main.go": "package main\n\nimport _ \"example.com/chain/p0\"\n\nfunc main() {}\n",
+	}
+	for i := 0; i < n; i++ {
+		src := fmt.Sprintf("package p%d\n", i)
+		if i+1 < n {
+			src += fmt.Sprintf("\nimport _ \"example.com/chain/p%d\"\n", i+1)
+		}
+		files[fmt.Sprintf("src/example.com/chain/p%d/p.go", i)] = src
+	}
+	return files
+}
+
+// returns the regular files of the tar archive at path by name
+func readTar(t *testing.T, path string) map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[hdr.Name] = string(data)
+		}
+	}
+}
+
+func TestDeepImportChain(t *testing.T) {
+	const n = 500
+	dir, cleanup := setupGOPATH(t, chainFiles(n))
+	defer cleanup()
+
+	// vendorized into memory, and from there into the archive
+	archive := filepath.Join(dir, "vendor.tar")
+	out, err := runVendorize(t, dir, nil, "-u", "-archive", archive, "example.com/app", "example.com/app/_vendor/src")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if want := fmt.Sprintf("%d packages vendorized, 1 skipped, 0 failed", n); !strings.Contains(out, want) {
+		t.Errorf("the output doesn't say %q:\n%s", want, out)
+	}
+	files := readTar(t, archive)
+	if len(files) != n {
+		t.Errorf("archived %d files, want %d", len(files), n)
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("example.com/chain/p%d/p.go", i)
+		src, ok := files[name]
+		if !ok {
+			t.Errorf("%s wasn't vendorized", name)
+			continue
+		}
+		if i+1 < n && !strings.Contains(src, fmt.Sprintf("import _ \"example.com/app/_vendor/src/example.com/chain/p%d\"", i+1)) {
+			t.Errorf("%s wasn't rewritten:\n%s", name, src)
+		}
+	}
+	root, err := ioutil.ReadFile(filepath.Join(dir, "src", "example.com", "app", "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(root, []byte(`"example.com/app/_vendor/src/example.com/chain/p0"`)) {
+		t.Errorf("the root package wasn't rewritten:\n%s", root)
+	}
+}
+
+// Run with -race, it checks the vendorize process too, being the same binary.
+func TestConcurrentMkdir(t *testing.T) {
+	const n = 200
+	files := map[string]string{}
+	var imports []string
+	for i := 0; i < n; i++ {
+		// siblings sharing every parent directory of the destination, each with a nested
+		// package copied by another worker
+		files[fmt.Sprintf("src/example.com/shared/deep/p%d/p.go", i)] = fmt.Sprintf("package p%d\n\nimport _ \"example.com/shared/deep/p%d/sub\"\n", i, i)
+		files[fmt.Sprintf("src/example.com/shared/deep/p%d/sub/s.go", i)] = "package sub\n"
+		imports = append(imports, fmt.Sprintf("import _ \"example.com/shared/deep/p%d\"\n", i))
+	}
+	files["src/example.com/app/main.go"] = "package main\n\n" + strings.Join(imports, "") + "\nfunc main() {}\n"
+	dir, cleanup := setupGOPATH(t, files)
+	defer cleanup()
+
+	out, err := runVendorize(t, dir, nil, "example.com/app", "example.com/app/_vendor/src")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if want := fmt.Sprintf("%d packages vendorized, 1 skipped, 0 failed", 2*n); !strings.Contains(out, want) {
+		t.Errorf("the output doesn't say %q:\n%s", want, out)
+	}
+	for i := 0; i < n; i++ {
+		for _, name := range []string{"p.go", "sub/s.go"} {
+			path := filepath.Join(dir, "src", "example.com", "app", "_vendor", "src", "example.com", "shared", "deep", fmt.Sprintf("p%d", i), filepath.FromSlash(name))
+			if _, err := os.Stat(path); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// and straight through the file system, many goroutines making the same parents at once
+	root := filepath.Join(dir, "mkdir")
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- osFS{}.MkdirAll(filepath.Join(root, "a", "b", "c", strconv.Itoa(i%10), strconv.Itoa(i)), 0770)
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSymlinkedGOPATH(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"gopath/src/example.com/app/main.go": "package main\n\nimport _ \"example.com/dep\"\n\nfunc main() {}\n",
+		"gopath/src/example.com/dep/dep.go":  "package dep\n",
+	})
+	defer cleanup()
+	target := filepath.Join(dir, "gopath")
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("can't make symbolic links: %s", err)
+	}
+
+	if got := canonicalPath(link); got != target {
+		t.Errorf("canonicalPath(%q) = %q, want %q", link, got, target)
+	}
+	// resolved through the nearest existing parent
+	if got, want := canonicalPath(filepath.Join(link, "src", "missing", "x")), filepath.Join(target, "src", "missing", "x"); got != want {
+		t.Errorf("canonicalPath of a missing path = %q, want %q", got, want)
+	}
+
+	out, err := runVendorize(t, link, nil, "-v", "-u", "example.com/app", "example.com/app/_vendor/src")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	want := fmt.Sprintf("Vendorizing example.com/dep from %q to %q", filepath.Join(target, "src", "example.com", "dep"),
+		filepath.Join(target, "src", "example.com", "app", "_vendor", "src", "example.com", "dep"))
+	if !strings.Contains(out, want) {
+		t.Errorf("the output doesn't say %q:\n%s", want, out)
+	}
+	if strings.Contains(out, link+string(filepath.Separator)) {
+		t.Errorf("the output names paths through the link:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(target, "src", "example.com", "app", "_vendor", "src", "example.com", "dep", "dep.go")); err != nil {
+		t.Error(err)
+	}
+	root, err := ioutil.ReadFile(filepath.Join(target, "src", "example.com", "app", "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(root, []byte(`"example.com/app/_vendor/src/example.com/dep"`)) {
+		t.Errorf("the root package wasn't rewritten:\n%s", root)
+	}
+}
+
+func TestFlattenSingleFile(t *testing.T) {
+	_, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/single/s.go":      "package single\n",
+		"src/example.com/two/a.go":         "package two\n",
+		"src/example.com/two/b.go":         "package two\n",
+		"src/example.com/tested/t.go":      "package tested\n",
+		"src/example.com/tested/t_test.go": "package tested\n",
+		"src/example.com/data/d.go":        "package data\n",
+		"src/example.com/data/d.txt":       "data\n",
+		"src/example.com/a/b_c/c.go":       "package b_c\n",
+		"src/example.com/a_b/c/c.go":       "package c\n",
+	})
+	defer cleanup()
+	defer func(f bool, d, vd string, c map[string]*build.Package, fc map[string]string) {
+		flattenSingleFile, flattenDir, vendorDest, claimed, foldedClaims = f, d, vd, c, fc
+	}(flattenSingleFile, flattenDir, vendorDest, claimed, foldedClaims)
+	flattenSingleFile, flattenDir = true, "single"
+	claimed, foldedClaims = make(map[string]*build.Package), make(map[string]string)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"example.com/single", "v/single/example.com_single"},
+		{"example.com/two", "v/example.com/two"},
+		{"example.com/tested", "v/example.com/tested"},
+		{"example.com/data", "v/example.com/data"},
+		{"example.com/a/b_c", "v/single/example.com_a_b_c"},
+	}
+	for _, test := range tests {
+		pkg, err := buildPackage(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := vendoredPath(pkg, "v")
+		if err != nil || got != test.want {
+			t.Errorf("%s is vendored at %q (%v), want %q", test.path, got, err, test.want)
+		}
+	}
+
+	// flattened to the same name as example.com/a/b_c
+	pkg, err := buildPackage("example.com/a_b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := vendoredPath(pkg, "v"); err == nil {
+		t.Errorf("%s is vendored at %q, want a collision with example.com/a/b_c", pkg.ImportPath, got)
+	} else if !strings.Contains(err.Error(), "collides with example.com/a/b_c") {
+		t.Errorf("the collision error doesn't name the other package: %s", err)
+	}
+}
+
+func TestRewriteSortsImports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s, g bool) { sortImports, gofmtOutput = s, g }(sortImports, gofmtOutput)
+
+	src := `package a
+
+import (
+	"os"
+	"fmt"
+
+	"example.com/zz"
+	"other.org/keep"
+	"example.com/aa"
+)
+
+var _, _, _, _, _ = os.Args, fmt.Sprint, zz.X, keep.X, aa.X
+`
+	m := map[string]string{"example.com/aa": "v/example.com/aa", "example.com/zz": "v/example.com/zz"}
+	golden := map[bool]string{
+		false: `package a
+
+import (
+	"os"
+	"fmt"
+
+	"v/example.com/zz"
+	"other.org/keep"
+	"v/example.com/aa"
+)
+
+var _, _, _, _, _ = os.Args, fmt.Sprint, zz.X, keep.X, aa.X
+`,
+		// sorted within each group, which are kept apart
+		true: `package a
+
+import (
+	"fmt"
+	"os"
+
+	"other.org/keep"
+	"v/example.com/aa"
+	"v/example.com/zz"
+)
+
+var _, _, _, _, _ = os.Args, fmt.Sprint, zz.X, keep.X, aa.X
+`,
+	}
+	path := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, sorted := range []bool{false, true} {
+		// printed as is, since formatting the way gofmt does sorts the imports too
+		sortImports, gofmtOutput = sorted, false
+		var buf bytes.Buffer
+		if _, _, err := rewriteFileImports(path, "", m, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != golden[sorted] {
+			t.Errorf("with -sort-imports=%v got:\n%s\nwant:\n%s", sorted, got, golden[sorted])
+		}
+	}
+}
+
+func TestUnsetGOPATH(t *testing.T) {
+	home, cleanup := setupGOPATH(t, map[string]string{
+		"go/src/example.com/app/go.mod":  "module example.com/app\n\nrequire example.com/cached v1.0.0\n",
+		"go/src/example.com/app/main.go": "package main\n\nimport (\n\t_ \"example.com/cached\"\n\t_ \"example.com/dep\"\n)\n\nfunc main() {}\n",
+		"go/src/example.com/dep/dep.go":  "package dep\n",
+		"go/src/example.com/cached/c.go": "package cached\n",
+		// the module cache under the default GOPATH
+		"go/pkg/mod/example.com/cached@v1.0.0/c.go": "package cached\n",
+	})
+	defer cleanup()
+	gopath := filepath.Join(home, "go")
+	vendored := filepath.Join(gopath, "src", "example.com", "app", "_vendor", "src", "example.com")
+
+	for _, env := range []struct {
+		name     string
+		vars     []string
+		fallback bool
+	}{
+		{"go env", nil, false},
+		// without the go tool, go/build's default is used
+		{"the environment", []string{"PATH=", "GOROOT=" + build.Default.GOROOT}, true},
+	} {
+		os.RemoveAll(filepath.Join(gopath, "src", "example.com", "app", "_vendor"))
+		vars := append([]string{"HOME=" + home, "GOPATH=", "GOMODCACHE=", "GOENV=off"}, env.vars...)
+		out, err := runVendorize(t, home, vars, "-v", "-skip-in-cache", "example.com/app", "example.com/app/_vendor/src")
+		if err != nil {
+			t.Fatalf("with %s: %s\n%s", env.name, err, out)
+		}
+		if fellBack := strings.Contains(out, "Couldn't run go env"); fellBack != env.fallback {
+			t.Errorf("with %s, fell back to the environment: %v\n%s", env.name, fellBack, out)
+		}
+		if strings.Contains(out, "GOPATH must be set") {
+			t.Errorf("with %s, GOPATH wasn't defaulted:\n%s", env.name, out)
+		}
+		if _, err := os.Stat(filepath.Join(vendored, "dep", "dep.go")); err != nil {
+			t.Errorf("with %s, the dependency wasn't copied into the default GOPATH: %s\n%s", env.name, err, out)
+		}
+		if _, err := os.Stat(filepath.Join(vendored, "cached")); !os.IsNotExist(err) {
+			t.Errorf("with %s, the package in the default module cache was copied: %v\n%s", env.name, err, out)
+		}
+	}
+}
+
+func TestReplaceFileAcrossDevices(t *testing.T) {
+	defer func(fs FileSystem, dir string) { fsys, tmpDir = fs, dir }(fsys, tmpDir)
+	mem := newMemFS()
+	fsys = crossDeviceFS{mem}
+	tmpDir = filepath.Join(string(filepath.Separator), "other")
+	dest := filepath.Join(string(filepath.Separator), "dest", "a.go")
+	for _, dir := range []string{tmpDir, filepath.Dir(dest)} {
+		if err := mem.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := replaceFile(dest, 0640, func(w io.Writer) error {
+		_, err := io.WriteString(w, "package a\n")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("replaceFile: %s", err)
+	}
+	f, err := mem.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(got) != "package a\n" {
+		t.Errorf("%s holds %q (%v), want the written content", dest, got, err)
+	}
+	info, err := mem.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("%s has mode %v, want %v", dest, info.Mode().Perm(), os.FileMode(0640))
+	}
+	if entries, err := readDir(tmpDir); err != nil || len(entries) > 0 {
+		t.Errorf("the temp dir holds %d files (%v), want none left", len(entries), err)
+	}
+}
+
+func TestCopyKeepsFileModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(m fileModeFlag) { fileMode = m }(fileMode)
+
+	src := filepath.Join(dir, "src")
+	modes := map[string]os.FileMode{"run.sh": 0755, "secret.go": 0600, "a.go": 0644}
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range modes {
+		path := filepath.Join(src, name)
+		if err := ioutil.WriteFile(path, []byte("package a\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+		// regardless of the umask
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, set := range []string{"", "0444"} {
+		fileMode = fileModeFlag{}
+		if set != "" {
+			if err := fileMode.Set(set); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dest := filepath.Join(dir, "dest"+set)
+		var m packageMetrics
+		if err := copyDir(dest, src, nil, &m); err != nil {
+			t.Fatal(err)
+		}
+		for name, mode := range modes {
+			want := mode
+			if set != "" {
+				want = 0444
+			}
+			info, err := os.Stat(filepath.Join(dest, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != want {
+				t.Errorf("with -file-mode %q, %s was copied with mode %v, want %v", set, name, info.Mode().Perm(), want)
+			}
+		}
+	}
+}
+
+func TestVerifyGofmt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(v, g bool, u []string) { verifyGofmt, gofmtOutput, unformatted = v, g, u }(verifyGofmt, gofmtOutput, unformatted)
+	verifyGofmt = true
+
+	// sorted and formatted, until the rewrite puts the first import after the second
+	src := "package a\n\nimport (\n\t\"example.com/b\"\n\t\"example.com/c\"\n)\n\nvar _, _ = b.X, c.X\n"
+	m := map[string]string{"example.com/b": "z/example.com/b"}
+	for _, gofmt := range []bool{false, true} {
+		path := filepath.Join(dir, "a.go")
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		gofmtOutput, unformatted = gofmt, nil
+		if _, err := rewriteFile(path, path, "", m); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		formatted, err := format.Source(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compliant := bytes.Equal(got, formatted)
+		if compliant != gofmt {
+			t.Errorf("with -gofmt=%v, the rewritten file is gofmt-compliant: %v\n%s", gofmt, compliant, got)
+		}
+		if reported := contains(unformatted, path); reported == compliant {
+			t.Errorf("with -gofmt=%v, the file was reported as unformatted: %v", gofmt, reported)
+		}
+	}
+}
+
+func TestRewriteImportComment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(g bool) { gofmtOutput = g }(gofmtOutput)
+	gofmtOutput = true
+
+	const newPath = "example.com/app/_vendor/src/example.com/foo"
+	tests := []struct {
+		src     string
+		newPath string
+		want    string // the package clause after the rewrite, or "" if unchanged
+	}{
+		{"package foo // import \"example.com/foo\"\n", newPath, "package foo // import \"" + newPath + "\"\n"},
+		{"package foo /* import \"example.com/foo\" */\n", newPath, "package foo /* import \"" + newPath + "\" */\n"},
+		// left alone without -rewrite-canonical-import-comment
+		{"package foo // import \"example.com/foo\"\n", "", ""},
+		// already pointing there
+		{"package foo // import \"" + newPath + "\"\n", newPath, ""},
+		// not an import comment
+		{"package foo // imports \"example.com/foo\"\n", newPath, ""},
+		{"package foo\n\n// import \"example.com/foo\"\n", newPath, ""},
+	}
+	for _, test := range tests {
+		sub, err := ioutil.TempDir(dir, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(sub, "foo.go")
+		if err := ioutil.WriteFile(path, []byte(test.src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		_, changed, err := rewriteFileImports(path, test.newPath, nil, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != (test.want != "") {
+			t.Errorf("%q with %q: changed is %v", test.src, test.newPath, changed)
+		}
+		if !changed {
+			continue
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%q rewritten to %q, want %q", test.src, got, test.want)
+		}
+		// and the go tool takes the copy to be at its new path
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pkg, err := build.ImportDir(sub, build.ImportComment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg.ImportComment != newPath {
+			t.Errorf("the rewritten package declares %q, want %q", pkg.ImportComment, newPath)
+		}
+	}
+}
+
+func TestSrcRoot(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"gopath/src/example.com/app/main.go":       "package main\n\nimport _ \"example.com/ext\"\n\nfunc main() {}\n",
+		"workspace/src/example.com/ext/ext.go":     "package ext\n\nimport _ \"example.com/ext/inner\"\n",
+		"workspace/src/example.com/ext/inner/i.go": "package inner\n",
+	})
+	defer cleanup()
+	gopath, workspace := filepath.Join(dir, "gopath"), filepath.Join(dir, "workspace")
+
+	if out, _ := runVendorize(t, gopath, nil, "example.com/app", "example.com/app/_vendor/src"); !strings.Contains(out, `cannot find package "example.com/ext"`) {
+		t.Errorf("found a package outside of GOPATH without -src-root:\n%s", out)
+	}
+	if out, err := runVendorize(t, gopath, nil, "-src-root", gopath+"/src", "example.com/app", "example.com/app/_vendor/src"); err == nil || !strings.Contains(out, "it has no src directory") {
+		t.Errorf("a -src-root without a src directory: %v\n%s", err, out)
+	}
+
+	out, err := runVendorize(t, gopath, nil, "-u", "-src-root", workspace, "example.com/app", "example.com/app/_vendor/src")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	vendored := filepath.Join(gopath, "src", "example.com", "app", "_vendor", "src", "example.com", "ext")
+	for _, name := range []string{"ext.go", "inner/i.go"} {
+		if _, err := os.Stat(filepath.Join(vendored, filepath.FromSlash(name))); err != nil {
+			t.Errorf("not copied into GOPATH: %s\n%s", err, out)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(workspace, "src", "example.com", "app")); !os.IsNotExist(err) {
+		t.Errorf("wrote into the -src-root: %v", err)
+	}
+	ext, err := ioutil.ReadFile(filepath.Join(vendored, "ext.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(ext, []byte(`"example.com/app/_vendor/src/example.com/ext/inner"`)) {
+		t.Errorf("the copy wasn't rewritten:\n%s", ext)
+	}
+	if orig, err := ioutil.ReadFile(filepath.Join(workspace, "src", "example.com", "ext", "ext.go")); err != nil || bytes.Contains(orig, []byte("_vendor")) {
+		t.Errorf("the source in the -src-root was rewritten: %v\n%s", err, orig)
+	}
+}
+
+func TestNormalizeAliases(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/dep/dep.go":   "package dep\n",
+		"src/example.com/go-yaml/y.go": "package yaml\n",
+		"src/example.com/a/log/log.go": "package log\n",
+		"src/example.com/b/log/log.go": "package log\n",
+	})
+	defer cleanup()
+	defer func(n, g, q bool) { normalizeImports, gofmtOutput, quiet = n, g, q }(normalizeImports, gofmtOutput, quiet)
+	normalizeImports, gofmtOutput, quiet = true, true, false
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	m := map[string]string{
+		"example.com/dep":     "v/example.com/dep",
+		"example.com/go-yaml": "v/example.com/go-yaml",
+		"example.com/a/log":   "v/example.com/a/log",
+		"example.com/b/log":   "v/example.com/b/log",
+	}
+	tests := []struct {
+		name    string
+		imports string
+		want    string
+		warning string
+	}{
+		{"redundant alias", `dep "example.com/dep"`, `"v/example.com/dep"`, ""},
+		{"missing alias", `"example.com/go-yaml"`, `yaml "v/example.com/go-yaml"`, ""},
+		{"other alias", `d "example.com/dep"`, `d "v/example.com/dep"`, ""},
+		{"colliding alias", "\"example.com/a/log\"\n\tlog \"example.com/b/log\"", "\"v/example.com/a/log\"\n\t\"v/example.com/b/log\"",
+			"imports both v/example.com/a/log and v/example.com/b/log as log"},
+	}
+	for _, test := range tests {
+		logged.Reset()
+		path := filepath.Join(dir, "a.go")
+		src := "package a\n\nimport (\n\t" + test.imports + "\n)\n"
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, _, err := rewriteFileImports(path, "", m, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if want := "package a\n\nimport (\n\t" + test.want + "\n)\n"; buf.String() != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, buf.String(), want)
+		}
+		if warned := logged.String(); test.warning == "" && warned != "" || !strings.Contains(warned, test.warning) {
+			t.Errorf("%s: logged %q, want %q", test.name, warned, test.warning)
+		}
+	}
+}
+
+func TestSymlinkedPackageDir(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"gopath/src/example.com/app/main.go": "package main\n\nimport _ \"example.com/linked\"\n\nfunc main() {}\n",
+		"monorepo/lib/lib.go":                "package linked\n",
+	})
+	defer cleanup()
+	gopath, target := filepath.Join(dir, "gopath"), filepath.Join(dir, "monorepo", "lib")
+	if err := os.Symlink(target, filepath.Join(gopath, "src", "example.com", "linked")); err != nil {
+		t.Skipf("can't make symbolic links: %s", err)
+	}
+	vendored := filepath.Join(gopath, "src", "example.com", "app", "_vendor", "src", "example.com", "linked")
+
+	for _, follow := range []bool{true, false} {
+		os.RemoveAll(filepath.Join(gopath, "src", "example.com", "app", "_vendor"))
+		out, err := runVendorize(t, gopath, nil, "-follow-symlinked-packages="+strconv.FormatBool(follow), "example.com/app", "example.com/app/_vendor/src")
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		if !strings.Contains(out, "1 packages vendorized") {
+			t.Errorf("with -follow-symlinked-packages=%v, the package wasn't vendorized:\n%s", follow, out)
+		}
+		info, err := os.Lstat(vendored)
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		if linked := info.Mode()&os.ModeSymlink != 0; linked == follow {
+			t.Errorf("with -follow-symlinked-packages=%v, the copy is a link: %v", follow, linked)
+		}
+		if canonicalPath(vendored) == target && follow {
+			t.Errorf("the copy is the source")
+		} else if !follow && canonicalPath(vendored) != target {
+			t.Errorf("the link points to %q, want %q", canonicalPath(vendored), target)
+		}
+		if _, err := os.Stat(filepath.Join(vendored, "lib.go")); err != nil {
+			t.Error(err)
+		}
+	}
+	// the source itself is left alone
+	if entries, err := ioutil.ReadDir(target); err != nil || len(entries) != 1 {
+		t.Errorf("the link target holds %d files (%v), want 1", len(entries), err)
+	}
+}
+
+func TestAllowGoroot(t *testing.T) {
+	const mainSrc = "package main\n\nimport (\n\t\"container/list\"\n\t\"fmt\"\n)\n\nfunc main() { fmt.Println(list.New()) }\n"
+	dir, cleanup := setupGOPATH(t, map[string]string{"src/example.com/app/main.go": mainSrc})
+	defer cleanup()
+	app := filepath.Join(dir, "src", "example.com", "app")
+	vendored := filepath.Join(app, "_vendor", "src", "container", "list")
+
+	for _, allow := range []bool{false, true} {
+		os.RemoveAll(filepath.Join(app, "_vendor"))
+		if err := ioutil.WriteFile(filepath.Join(app, "main.go"), []byte(mainSrc), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args := []string{"-u", "example.com/app", "example.com/app/_vendor/src"}
+		if allow {
+			args = append([]string{"-allow-goroot", "container/list"}, args...)
+		}
+		out, err := runVendorize(t, dir, nil, args...)
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		src, err := ioutil.ReadFile(filepath.Join(app, "main.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, statErr := os.Stat(filepath.Join(vendored, "list.go"))
+		if copied := statErr == nil; copied != allow {
+			t.Errorf("with -allow-goroot=%v, container/list was copied: %v\n%s", allow, copied, out)
+		}
+		if rewritten := bytes.Contains(src, []byte(`"example.com/app/_vendor/src/container/list"`)); rewritten != allow {
+			t.Errorf("with -allow-goroot=%v, the import was rewritten: %v\n%s", allow, rewritten, src)
+		}
+		if !bytes.Contains(src, []byte(`"fmt"`)) {
+			t.Errorf("with -allow-goroot=%v, fmt was rewritten:\n%s", allow, src)
+		}
+		if warned := strings.Contains(out, "Warning: -allow-goroot vendorizes container/list from GOROOT"); warned != allow {
+			t.Errorf("with -allow-goroot=%v, warned about it: %v\n%s", allow, warned, out)
+		}
+	}
+}
+
+func TestSkipHidden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s bool, i stringSliceFlag, d map[string]string) { skipHidden, includeHidden, destDirs = s, i, d }(skipHidden, includeHidden, destDirs)
+	destDirs = make(map[string]string)
+
+	src := filepath.Join(dir, "src")
+	files := []string{"a.go", "_helper.go", "_data/d.txt", ".gitignore", ".golangci.yml", ".gitattributes", ".github/workflow.yml", "sub/.hidden"}
+	for _, name := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		skip    bool
+		include []string
+		want    []string
+	}{
+		{false, nil, files},
+		// files starting with an underscore aren't hidden, though go/build ignores them
+		{true, nil, []string{"a.go", "_helper.go", "_data/d.txt"}},
+		{true, []string{".gitattr*"}, []string{"a.go", "_helper.go", "_data/d.txt", ".gitattributes"}},
+	}
+	for i, test := range tests {
+		skipHidden, includeHidden = test.skip, test.include
+		dest := filepath.Join(dir, "dest"+strconv.Itoa(i))
+		var m packageMetrics
+		if err := copyTree(dest, src, nil, &m); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(dest, path)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		want := append([]string(nil), test.want...)
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("with -skip-hidden=%v -include %v, copied %v, want %v", test.skip, test.include, got, want)
+		}
+	}
+}
+
+// BenchmarkVendorizeWideGraph measures a whole run over a graph wide enough to keep
+// every worker busy, so that results come in bursts for the loop to drain.
+func BenchmarkVendorizeWideGraph(b *testing.B) {
+	const n = 300
+	files := map[string]string{}
+	var imports []string
+	for i := 0; i < n; i++ {
+		files[fmt.Sprintf("src/example.com/wide/p%d/p.go", i)] = fmt.Sprintf("package p%d\n", i)
+		imports = append(imports, fmt.Sprintf("import _ \"example.com/wide/p%d\"\n", i))
+	}
+	files["src/example.com/app/main.go"] = "package main\n\n" + strings.Join(imports, "") + "\nfunc main() {}\n"
+	dir, cleanup := setupGOPATH(b, files)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		os.RemoveAll(filepath.Join(dir, "src", "example.com", "app", "_vendor"))
+		b.StartTimer()
+		if out, err := runVendorize(b, dir, nil, "-q", "example.com/app", "example.com/app/_vendor/src"); err != nil {
+			b.Fatalf("%s\n%s", err, out)
+		}
+	}
+}
+
+func TestDestMapWithPruning(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/app/main.go":      "package main\n\nimport _ \"example.com/dep\"\n\nfunc main() {}\n",
+		"src/example.com/app/main_test.go": "package main\n\nimport (\n\t_ \"example.com/mapped\"\n\t_ \"example.com/unmapped\"\n)\n",
+		"src/example.com/dep/dep.go":       "package dep\n",
+		"src/example.com/mapped/m.go":      "package mapped\n",
+		"src/example.com/unmapped/u.go":    "package unmapped\n",
+		"map.txt":                          "example.com/mapped=example.com/app/internal/mapped\n",
+	})
+	defer cleanup()
+	app := filepath.Join(dir, "src", "example.com", "app")
+	for _, flags := range [][]string{{"-exclude-test-only-deps"}, {"-keep-reachable-from", "example.com/dep"}} {
+		os.RemoveAll(filepath.Join(app, "_vendor"))
+		os.RemoveAll(filepath.Join(app, "internal"))
+		args := append([]string{"-dest-map", filepath.Join(dir, "map.txt")}, flags...)
+		out, err := runVendorize(t, dir, nil, append(args, "example.com/app", "example.com/app/_vendor/src")...)
+		if err != nil {
+			t.Fatalf("%v: %s\n%s", flags, err, out)
+		}
+		if _, err := os.Stat(filepath.Join(app, "internal", "mapped", "m.go")); err != nil {
+			t.Errorf("%v removed the package mapped outside the destination: %s\n%s", flags, err, out)
+		}
+		if _, err := os.Stat(filepath.Join(app, "_vendor", "src", "example.com", "unmapped")); !os.IsNotExist(err) {
+			t.Errorf("%v kept example.com/unmapped: %v\n%s", flags, err, out)
+		}
+		if _, err := os.Stat(filepath.Join(app, "_vendor", "src", "example.com", "dep", "dep.go")); err != nil {
+			t.Errorf("%v removed example.com/dep: %s\n%s", flags, err, out)
+		}
+	}
+}
+
+func TestCheckPackageNameReportsBothSources(t *testing.T) {
+	dir, cleanup := setupGOPATH(t, map[string]string{
+		"src/example.com/first/first.go":   "package first\n",
+		"src/example.com/second/second.go": "package second\n",
+		"dest/first.go":                    "package first\n",
+	})
+	defer cleanup()
+	defer func(c map[string]*build.Package) { claimed = c }(claimed)
+	firstDir := filepath.Join(dir, "src", "example.com", "first")
+	claimed = map[string]*build.Package{"v/example.com/first": {ImportPath: "example.com/first", Dir: firstDir}}
+	second := &build.Package{ImportPath: "example.com/second", Name: "second", Dir: filepath.Join(dir, "src", "example.com", "second")}
+	dest := filepath.Join(dir, "dest")
+
+	err := checkPackageName(dest, second, firstDir)
+	if err == nil {
+		t.Fatal("copied package second over package first")
+	}
+	for _, want := range []string{"first.go", "example.com/first", strconv.Quote(firstDir), "example.com/second", strconv.Quote(second.Dir)} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("the error doesn't mention %s: %s", want, err)
+		}
+	}
+	if err := checkPackageName(dest, second, ""); err == nil || !strings.Contains(err.Error(), "which this run didn't copy") {
+		t.Errorf("a package left by an earlier run: %v", err)
+	}
+	first := &build.Package{ImportPath: "example.com/first", Name: "first", Dir: firstDir}
+	if err := checkPackageName(dest, first, firstDir); err != nil {
+		t.Errorf("refused to copy a package over itself: %s", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileSums are the SHA-256 sums of the files written in this run, so that writing the
+// checksum manifest doesn't have to read them again.
+var fileSums = make(map[string][]byte)
+
+// records the sum of the file written to path
+func recordSum(path string, sum []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	fileSums[path] = sum
+}
+
+// returns the SHA-256 sum of the file at path
+func fileSum(path string) ([]byte, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// returns the sums of every file under root, keyed by slash-separated paths relative to
+// root, leaving out the file skip. Files not written in this run are hashed, or taken from
+// the -hash-cache.
+func treeSums(root, skip string) (map[string]string, error) {
+	hashCacheRoot(root)
+	sums := make(map[string]string)
+	err := fsys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || path == skip {
+			return nil
+		}
+		mu.Lock()
+		sum, ok := fileSums[path]
+		mu.Unlock()
+		if !ok {
+			if sum, err = cachedFileSum(path, info); err != nil {
+				return err
+			}
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sums[filepath.ToSlash(rel)] = hex.EncodeToString(sum)
+		return nil
+	})
+	return sums, err
+}
+
+// writes the sums of every file under root to file, in the format of sha256sum
+func writeManifest(file, root string) error {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	sums, err := treeSums(root, file)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(sums))
+	for path := range sums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, path := range paths {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[path], path)
+	}
+	verbosef("Writing checksum manifest to %q", file)
+	if dry {
+		return nil
+	}
+	return writeFile(file, &buf, 0660)
+}
+
+// checks the files under root against the checksum manifest file, logging every file
+// that is missing, extra or differs. It returns the number of such files.
+func verifyManifest(file, root string) (int, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return 0, err
+	}
+	data, err := readFile(file)
+	if err != nil {
+		return 0, err
+	}
+	want := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("%s:%d: malformed checksum line", file, line)
+		}
+		want[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	got, err := treeSums(root, file)
+	if err != nil {
+		return 0, err
+	}
+	var problems []string
+	for path, sum := range want {
+		switch gotSum, ok := got[path]; {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: missing", path))
+		case gotSum != sum:
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch", path))
+		}
+	}
+	for path := range got {
+		if _, ok := want[path]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: not in the manifest", path))
+		}
+	}
+	sort.Strings(problems)
+	for _, problem := range problems {
+		errorf("%s", problem)
+	}
+	return len(problems), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+// packageMetrics are what was measured while vendorizing a package. They travel in its
+// result, so that the reports built from them are aggregated by the loop draining the
+// results alone, without locking.
+type packageMetrics struct {
+	files   int         // files copied, or that would have been with -d
+	bytes   int64       // bytes of those files
+	source  string      // sourceModCache or sourceWorkspace, with -flag-cache-source
+	license licenseInfo // with -report-licenses or -license-report-csv
+	rev     godep       // revision of the repository of the package, with -vendor-spec
+}
+
+var (
+	copiedFiles     int                               // files copied by the run
+	copiedBytes     int64                             // bytes of those files
+	vendoredMetrics = make(map[string]packageMetrics) // by import path of the packages vendorized in this run
+)
+
+// adds the metrics of a package vendorized in this run to those of the run. Only ever
+// called by the loop draining the results.
+func recordMetrics(r vendorizeResult) {
+	copiedFiles += r.metrics.files
+	copiedBytes += r.metrics.bytes
+	if r.metrics.source != "" {
+		packageSources[r.path] = r.metrics.source
+	}
+	vendoredMetrics[r.path] = r.metrics
+}
+
+// logs how many files and bytes the run copied
+func reportCopied() {
+	if copiedFiles == 0 {
+		return
+	}
+	verb := "Copied"
+	if dry {
+		verb = "Would have copied"
+	}
+	infof("%s %d files, %s", verb, copiedFiles, formatSize(copiedBytes))
+}
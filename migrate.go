@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// parses -rewrite-from-to values of the form old=new into the rewrites they ask for
+func parseFromTo(values []string) (map[string]string, error) {
+	m := make(map[string]string, len(values))
+	for _, value := range values {
+		i := strings.Index(value, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid -rewrite-from-to %q: expected old=new", value)
+		}
+		from, to := value[:i], value[i+1:]
+		for _, path := range []string{from, to} {
+			if err := validImportPath(path); err != nil {
+				return nil, fmt.Errorf("Invalid -rewrite-from-to %q: %s", value, err)
+			}
+		}
+		if prev, ok := m[from]; ok && prev != to {
+			return nil, fmt.Errorf("Invalid -rewrite-from-to %q: %s is already rewritten to %s", value, from, prev)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// rewrites the imports of every Go file under dir in place with m and the -rewrite-re
+// patterns, without vendorizing anything, for -rewrite-from-to. Directories are left out
+// like with -update-all-imports-in-root. A file failing to rewrite is logged and the others
+// are still rewritten; the number of files that failed is returned.
+func rewriteTree(dir string, m map[string]string) (int, error) {
+	var files []string
+	err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != dir && (vcsDirs[name] || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, ".go") && (rewriteTests || !strings.HasSuffix(name, "_test.go")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	failed, changed, imports := 0, 0, 0
+	for _, file := range files {
+		var n int
+		var err error
+		if dry {
+			// rendered for nothing, to tell which files would change
+			n, _, err = rewriteFileImports(file, "", m, ioutil.Discard)
+			if err == nil && n > 0 {
+				planned("rewrite", file, "")
+			}
+		} else {
+			n, err = rewriteFile(file, file, "", m)
+		}
+		if err != nil && skipUnparseable && isParseError(err) {
+			infof("Warning: not rewriting %q: it isn't valid Go: %s", file, err)
+			continue
+		}
+		if err != nil {
+			errorf("Couldn't rewrite file %q: %s", file, err)
+			failed++
+			continue
+		}
+		if n > 0 {
+			verbosef("Rewrote %d imports in %q", n, file)
+			changed++
+			imports += n
+		}
+	}
+
+	atomic.StoreInt32(&summarizing, 1)
+	verb := "Rewrote"
+	if dry {
+		verb = "Would rewrite"
+	}
+	infof("%s %d imports in %d of the %d Go files of %q", verb, imports, changed, len(files), dir)
+	if len(pendingHooks) > 0 {
+		failed += len(runHooks())
+	}
+	return failed, nil
+}
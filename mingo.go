@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/build"
+	"go/build/constraint"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// minGoMinor is the minor version of the Go release given by -min-go, or 0 without it.
+var minGoMinor int
+
+// newerGo maps the import paths of vendorized packages that need a newer Go than -min-go
+// to why they do.
+var newerGo = make(map[string]string)
+
+// unixGOOS are the operating systems the unix build tag is satisfied on.
+var unixGOOS = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true, "hurd": true, "illumos": true,
+	"ios": true, "linux": true, "netbsd": true, "openbsd": true, "solaris": true,
+}
+
+// parses -min-go, given like go1.16 or 1.16
+func checkMinGo() error {
+	if minGo == "" {
+		return nil
+	}
+	minor, ok := goMinor(minGo)
+	if !ok {
+		return fmt.Errorf("Invalid -min-go %q: expected a Go release like go1.16", minGo)
+	}
+	minGoMinor = minor
+	return nil
+}
+
+// returns the minor version of the Go 1 release v, given like go1.21, 1.21 or 1.21.0
+func goMinor(v string) (int, bool) {
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "go"), "1.")
+	if i := strings.IndexByte(v, '.'); i >= 0 {
+		v = v[:i]
+	}
+	minor, err := strconv.Atoi(v)
+	return minor, err == nil && minor >= 0
+}
+
+// returns the minor version of the newest Go release known to go/build
+func currentGoMinor() int {
+	tags := build.Default.ReleaseTags
+	minor, _ := goMinor(tags[len(tags)-1])
+	return minor
+}
+
+// warns about and records pkg if it needs a newer Go than -min-go: because build
+// constraints leave all of its files out of older releases, or because the go.mod of its
+// module declares a newer go version. Files built only by newer releases are fine as long
+// as others, like !go1.21 fallbacks, build with -min-go. This is a best-effort check; code
+// using new features without saying so isn't caught.
+func checkGoVersion(pkg *build.Package) error {
+	var reasons []string
+	ctx := build.Default
+	ctx.GOOS = goEnv("GOOS")
+	ctx.GOARCH = goEnv("GOARCH")
+	ctx.BuildTags = splitBuildTags()
+	ctx.ReleaseTags = nil
+	for minor := 1; minor <= minGoMinor; minor++ {
+		ctx.ReleaseTags = append(ctx.ReleaseTags, fmt.Sprintf("go1.%d", minor))
+	}
+	var newer []string
+	built := false
+	for _, file := range append(append(append([]string(nil), pkg.GoFiles...), pkg.CgoFiles...), pkg.IgnoredGoFiles...) {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		ok, err := ctx.MatchFile(pkg.Dir, file)
+		if err != nil {
+			return err
+		}
+		if ok {
+			built = true
+			break
+		}
+		expr, err := fileConstraint(filepath.Join(pkg.Dir, file))
+		if err != nil {
+			return err
+		}
+		if expr == nil {
+			continue
+		}
+		if minor := constraintMinGo(expr); minor > minGoMinor {
+			newer = append(newer, fmt.Sprintf("%s is only built by go1.%d or later", file, minor))
+		}
+	}
+	if !built && len(newer) > 0 {
+		reasons = append(reasons, fmt.Sprintf("none of its files are built by go1.%d: %s", minGoMinor, strings.Join(newer, ", ")))
+	}
+
+	srcRoot := canonicalPath(filepath.Join(pkg.Root, "src"))
+	if file, ok := findGoMod(pkg.Dir); ok && strings.HasPrefix(file, srcRoot+string(filepath.Separator)) {
+		err := scanGoMod(file, "go", func(line int, fields []string) error {
+			if minor, ok := goMinor(fields[0]); ok && minor > minGoMinor {
+				reasons = append(reasons, fmt.Sprintf("%s declares go %s", file, fields[0]))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+	why := strings.Join(reasons, "; ")
+	infof("Warning: %s needs a newer Go than -min-go %s: %s", pkg.ImportPath, minGo, why)
+	mu.Lock()
+	newerGo[pkg.ImportPath] = why
+	mu.Unlock()
+	return nil
+}
+
+// returns the build constraint of the Go file at path, or nil if it has none. A //go:build
+// line wins over // +build lines, as it does for the go tool.
+func fileConstraint(path string) (constraint.Expr, error) {
+	src, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var goBuild constraint.Expr
+	var plusBuild []constraint.Expr
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if !constraint.IsGoBuild(line) && !constraint.IsPlusBuild(line) {
+			continue
+		}
+		expr, err := constraint.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if constraint.IsGoBuild(line) {
+			goBuild = expr
+		} else {
+			plusBuild = append(plusBuild, expr)
+		}
+	}
+	if goBuild != nil || len(plusBuild) == 0 {
+		return goBuild, nil
+	}
+	expr := plusBuild[0]
+	for _, e := range plusBuild[1:] {
+		expr = &constraint.AndExpr{X: expr, Y: e}
+	}
+	return expr, nil
+}
+
+// returns the oldest Go 1 minor release expr is satisfied by on the current platform, or
+// 0 when no release tag matters
+func constraintMinGo(expr constraint.Expr) int {
+	current := currentGoMinor()
+	tags := make(map[string]bool)
+	for _, tag := range splitBuildTags() {
+		tags[tag] = true
+	}
+	for minor := 0; minor <= current; minor++ {
+		ok := expr.Eval(func(tag string) bool {
+			if v, isRelease := releaseTagMinor(tag); isRelease {
+				return v <= minor
+			}
+			return tag == goEnv("GOOS") || tag == goEnv("GOARCH") || tag == "cgo" || tag == "gc" ||
+				tag == "unix" && unixGOOS[goEnv("GOOS")] || tags[tag]
+		})
+		if ok {
+			return minor
+		}
+	}
+	return 0
+}
+
+// returns the minor version of the release tag tag, like go1.21
+func releaseTagMinor(tag string) (int, bool) {
+	if !strings.HasPrefix(tag, "go1.") {
+		return 0, false
+	}
+	return goMinor(tag)
+}
+
+// lists the vendorized packages that need a newer Go than -min-go
+func reportMinGo() {
+	if len(newerGo) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(newerGo))
+	for path := range newerGo {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	infof("Vendorized %d packages needing a newer Go than -min-go %s:", len(paths), minGo)
+	for _, path := range paths {
+		infof("  %s: %s", path, newerGo[path])
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// prune removes every file under root that doesn't belong to a package vendorized in this run,
+// then removes the directories left empty. Only paths under root are ever touched.
+func prune(root string) error {
+	var files, dirs []string
+	err := fsys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !stale(path) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := remove(root, file); err != nil {
+			return err
+		}
+	}
+
+	// remove the deepest directories first so parents can empty out
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if empty, err := emptyDir(dir, files); err != nil || !empty {
+			continue
+		}
+		if err := remove(root, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reports whether the file at path isn't part of a vendorized package's copied contents,
+// nor a backup of a file replaced in this run
+func stale(path string) bool {
+	if isLinkedDir(path) {
+		return false
+	}
+	mu.Lock()
+	backup := backups[path]
+	mu.Unlock()
+	if backup {
+		return false
+	}
+	if skippedHidden(filepath.Base(path)) {
+		return true
+	}
+	srcDir, ok := destDirs[filepath.Dir(path)]
+	if !ok {
+		return true
+	}
+	srcExists, _ := exists(filepath.Join(srcDir, filepath.Base(path)))
+	return !srcExists
+}
+
+// reports whether dir would be empty once the removed paths are gone
+func emptyDir(dir string, removed []string) (bool, error) {
+	entries, err := readDir(dir)
+	if err != nil {
+		return false, err
+	}
+	gone := make(map[string]bool, len(removed))
+	for _, path := range removed {
+		gone[path] = true
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !gone[path] {
+			if _, kept := destDirs[path]; kept || !entry.IsDir() {
+				return false, nil
+			}
+			if empty, err := emptyDir(path, removed); err != nil || !empty {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// removes path, refusing anything outside of root
+func remove(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Refusing to remove %q outside of %q", path, root)
+	}
+	infof("Removing %q", path)
+	planned("remove", path, "")
+	if dry {
+		return nil
+	}
+	return fsys.Remove(path)
+}
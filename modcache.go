@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// goModRequire is a require directive of a go.mod file.
+type goModRequire struct {
+	path    string // module path
+	version string // required version
+}
+
+// goModRequires are the requirements of the go.mod of the package, longest module path
+// first. Modules the go.mod replaces are left out, since the cached copy isn't the one
+// that gets built.
+var goModRequires []goModRequire
+
+// cachedPackages are the import paths of the packages left to the module cache.
+var cachedPackages []string
+
+// reads the require directives of the go.mod file at path into goModRequires
+func loadGoModRequires(path string) error {
+	replaced := make(map[string]bool)
+	err := scanGoMod(path, "replace", func(line int, fields []string) error {
+		replaced[fields[0]] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = scanGoMod(path, "require", func(line int, fields []string) error {
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: malformed require directive", path, line)
+		}
+		if !replaced[fields[0]] {
+			goModRequires = append(goModRequires, goModRequire{path: fields[0], version: fields[1]})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(goModRequires, func(i, j int) bool {
+		return len(goModRequires[i].path) > len(goModRequires[j].path)
+	})
+	return nil
+}
+
+// returns the directory of path in the module download cache, at the version the go.mod
+// requires, if the module providing it is required and has been downloaded
+func inModCache(path string) (string, bool) {
+	for _, r := range goModRequires {
+		if path != r.path && !strings.HasPrefix(path, r.path+"/") {
+			continue
+		}
+		root := filepath.Join(goEnv("GOMODCACHE"), filepath.FromSlash(escapeModulePath(r.path))+"@"+escapeModulePath(r.version))
+		dir := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(path, r.path)))
+		info, err := fsys.Stat(dir)
+		return dir, err == nil && info.IsDir()
+	}
+	return "", false
+}
+
+// escapes path the way the module cache does, so that it is safe on case-insensitive
+// file systems: every upper case letter becomes an exclamation mark followed by the letter
+// in lower case
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if unicode.IsUpper(r) {
+			b.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// records that the package at path is left to the module cache at dir
+func recordCached(path, dir string) {
+	mu.Lock()
+	defer mu.Unlock()
+	cachedPackages = append(cachedPackages, path)
+	verbosef("%s is in the module cache at %q", path, dir)
+}
+
+// logs how many packages were left to the module cache, and which with -v
+func reportCached() {
+	if len(cachedPackages) == 0 {
+		return
+	}
+	sort.Strings(cachedPackages)
+	infof("Left %d packages to the module cache", len(cachedPackages))
+	for _, path := range cachedPackages {
+		verbosef("  %s", path)
+	}
+}
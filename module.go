@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// goModVersion is the go directive written to generated go.mod files.
+const goModVersion = "1.16"
+
+// writes a minimal go.mod declaring modulePath at the root of dest, listing in a comment
+// the vendorized packages it contains
+func writeGoMod(modulePath, dest string) error {
+	if modulePath != dest && updateImports {
+		infof("Warning: module path %q differs from the destination %q, so rewritten imports won't resolve within the module", modulePath, dest)
+	}
+
+	var pkgs []string
+	for _, newPath := range rewrites {
+		if strings.HasPrefix(newPath, dest+"/") {
+			pkgs = append(pkgs, modulePath+strings.TrimPrefix(newPath, dest))
+		}
+	}
+	sort.Strings(pkgs)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Generated by vendorize. This module contains the vendorized packages:\n")
+	for _, pkg := range pkgs {
+		fmt.Fprintf(&buf, "//\t%s\n", pkg)
+	}
+	fmt.Fprintf(&buf, "\nmodule %s\n\ngo %s\n", modulePath, goModVersion)
+
+	root := filepath.Join(gopath, "src", dest)
+	file := filepath.Join(root, "go.mod")
+	verbosef("Writing %q", file)
+	planned("write", file, "")
+	if dry {
+		return nil
+	}
+	if err := fsys.MkdirAll(root, 0770); err != nil {
+		return err
+	}
+	return writeFile(file, &buf, 0660)
+}
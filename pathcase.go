@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// foldsCase is whether the file system under GOPATH's src directory ignores case, so that
+// import paths differing only in case share a directory.
+var foldsCase bool
+
+// foldedClaims maps the vendored import paths claimed so far, in lower case, to the paths
+// as given. Guarded by mu.
+var foldedClaims = make(map[string]string)
+
+// windowsReserved are the names Windows won't give a file or directory, with or without
+// an extension.
+var windowsReserved = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// reports whether the file system holding the existing directory dir ignores case, by
+// looking it up with its last element's case swapped. Nothing is written.
+func caseInsensitive(dir string) bool {
+	base := filepath.Base(dir)
+	swapped := strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, base)
+	if swapped == base {
+		return false
+	}
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return false
+	}
+	other, err := fsys.Stat(filepath.Join(filepath.Dir(dir), swapped))
+	return err == nil && os.SameFile(info, other)
+}
+
+// returns why the import path path would make for a troublesome directory on some file
+// system, or "" if it wouldn't: characters outside of those the go tool allows in module
+// paths, elements ending in a dot or a space, or names Windows reserves
+func pathProblem(path string) string {
+	for _, r := range path {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~+/", r) {
+			continue
+		}
+		return fmt.Sprintf("it contains %q", r)
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if strings.HasSuffix(elem, ".") {
+			return fmt.Sprintf("its element %q ends in a dot", elem)
+		}
+		name := strings.ToLower(elem)
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			name = name[:i]
+		}
+		if windowsReserved[name] {
+			return fmt.Sprintf("its element %q is reserved on Windows", elem)
+		}
+	}
+	return ""
+}
+
+// claims the vendored path newPath against the paths differing from it only in case,
+// returning an error when the destination ignores case and another package already has
+// one of them. Where case matters, the collision is only warned about, since the tree
+// can't be checked out on a file system ignoring case. The caller holds mu.
+func claimFolded(newPath, importPath string) error {
+	folded := strings.ToLower(newPath)
+	other, ok := foldedClaims[folded]
+	if !ok || other == newPath {
+		foldedClaims[folded] = newPath
+		return nil
+	}
+	if foldsCase {
+		return fmt.Errorf("Vendored path %q of %s differs only in case from %q, and the destination ignores case, so they would share a directory",
+			newPath, importPath, other)
+	}
+	infof("Warning: vendored path %q of %s differs only in case from %q; the destination can't be checked out where case is ignored", newPath, importPath, other)
+	return nil
+}
+
+// returns the path of the directory under root the slash separated path rel names, with
+// each element cased the way it is on disk, and whether that differs from rel. Only case
+// insensitive file systems can tell them apart.
+func diskCase(root, rel string) (string, bool) {
+	dir := root
+	differs := false
+	for _, elem := range strings.Split(rel, "/") {
+		entries, err := readDir(dir)
+		if err != nil {
+			return "", false
+		}
+		found := ""
+		for _, entry := range entries {
+			if entry.Name() == elem {
+				found = elem
+				break
+			}
+			if strings.EqualFold(entry.Name(), elem) {
+				found = entry.Name()
+			}
+		}
+		if found == "" {
+			return "", false
+		}
+		if found != elem {
+			differs = true
+		}
+		dir = filepath.Join(dir, found)
+	}
+	return dir, differs
+}
+
+// warns when the source directory of pkg, or the directory it was copied to at newPath,
+// is cased differently on disk than its import path. On a file system ignoring case the
+// go tool finds the package either way, but nowhere else does.
+func checkDiskCase(pkg *build.Package, newPath string) {
+	src := filepath.Join(pkg.Root, "src")
+	if !pkg.Goroot && strings.EqualFold(pkg.Dir, filepath.Join(src, filepath.FromSlash(pkg.ImportPath))) {
+		if dir, differs := diskCase(src, pkg.ImportPath); differs {
+			infof("Warning: %s is imported as %q but is on disk as %q", pkg.ImportPath, pkg.ImportPath, dir)
+		}
+	}
+	if dir, differs := diskCase(filepath.Join(gopath, "src"), newPath); differs {
+		infof("Warning: %s was copied into %q, an existing directory cased differently from its vendored path %q", pkg.ImportPath, dir, newPath)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// rewritePattern rewrites every import path matching re to the expansion of repl.
+type rewritePattern struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// rewritePatterns are the patterns given by -rewrite-re, tried in order.
+var rewritePatterns []rewritePattern
+
+// parses -rewrite-re values of the form pattern=replacement. Patterns are anchored
+// so that they must match the full import path.
+func parseRewritePatterns(values []string) error {
+	for _, value := range values {
+		i := strings.LastIndex(value, "=")
+		if i <= 0 || i == len(value)-1 {
+			return fmt.Errorf("Invalid rewrite %q: expected pattern=replacement", value)
+		}
+		re, err := regexp.Compile("^(?:" + value[:i] + ")$")
+		if err != nil {
+			return fmt.Errorf("Invalid rewrite pattern %q: %s", value[:i], err)
+		}
+		rewritePatterns = append(rewritePatterns, rewritePattern{re: re, repl: value[i+1:]})
+	}
+	return nil
+}
+
+// returns the rewrite of path by the first matching pattern, if any
+func patternRewrite(path string) (string, bool, error) {
+	for _, p := range rewritePatterns {
+		if !p.re.MatchString(path) {
+			continue
+		}
+		rewritten := p.re.ReplaceAllString(path, p.repl)
+		if err := validImportPath(rewritten); err != nil {
+			return "", false, fmt.Errorf("Rewriting %s with %q: %s", path, p.re, err)
+		}
+		return rewritten, true, nil
+	}
+	return "", false, nil
+}
+
+// reports whether the package at path was vendorized at newPath in this run, whether
+// copied there or found there already, so that its imports may be rewritten by a pattern.
+// Packages from GOROOT and blacklisted ones never are, so a pattern as broad as
+// (.*)=v/$1 leaves their imports alone.
+func vendoredAt(path, newPath string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	pkg, ok := claimed[newPath]
+	return ok && pkg.ImportPath == path
+}
+
+// checks that path is usable as an import path
+func validImportPath(path string) error {
+	if path == "" {
+		return fmt.Errorf("empty import path")
+	}
+	if strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return fmt.Errorf("import path %q has a leading or trailing slash", path)
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("import path %q has an invalid element %q", path, elem)
+		}
+	}
+	// the characters the go command accepts in import paths
+	for _, r := range path {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-._~+/", r)) {
+			return fmt.Errorf("import path %q contains invalid character %q", path, r)
+		}
+	}
+	return nil
+}
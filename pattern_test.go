@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatternRewrite(t *testing.T) {
+	defer func(p []rewritePattern) { rewritePatterns = p }(rewritePatterns)
+	tests := []struct {
+		pattern string
+		path    string
+		want    string // "" for no match
+		err     bool
+	}{
+		{"golang.org/x/(.*)=myvendor/x/$1", "golang.org/x/net/context", "myvendor/x/net/context", false},
+		{"golang.org/x/(.*)=myvendor/x/$1", "golang.org/x/net", "myvendor/x/net", false},
+		// anchored to the full import path
+		{"golang.org/x/(.*)=myvendor/x/$1", "foo.golang.org/x/net", "", false},
+		{"golang.org/x/net=myvendor/net", "golang.org/x/net/context", "", false},
+		{"([^/]+)/([^/]+)/(.*)=v/$2/$1/$3", "github.com/user/repo/sub", "v/user/github.com/repo/sub", false},
+		{"github.com/(?P<user>[^/]+)/(.*)=v/${user}_$2", "github.com/user/repo", "v/user_repo", false},
+		// the substitutions must make for valid import paths
+		{"(.*)/x/(.*)=$1//$2", "golang.org/x/net", "", true},
+		{"(.*)=$1/", "example.com/a", "", true},
+		{"example.com/(.*)=v/$1 x", "example.com/a", "", true},
+	}
+	for _, test := range tests {
+		rewritePatterns = nil
+		if err := parseRewritePatterns([]string{test.pattern}); err != nil {
+			t.Fatalf("%q: %s", test.pattern, err)
+		}
+		got, ok, err := patternRewrite(test.path)
+		switch {
+		case test.err:
+			if err == nil {
+				t.Errorf("%q rewrites %s to %q, want an error", test.pattern, test.path, got)
+			}
+		case err != nil:
+			t.Errorf("%q on %s: %s", test.pattern, test.path, err)
+		case ok != (test.want != "") || got != test.want:
+			t.Errorf("%q rewrites %s to %q (%v), want %q", test.pattern, test.path, got, ok, test.want)
+		}
+	}
+
+	rewritePatterns = nil
+	if err := parseRewritePatterns([]string{"golang.org/x/(.*)=first/$1", "golang.org/(.*)=second/$1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := patternRewrite("golang.org/x/net"); got != "first/net" {
+		t.Errorf("got %q, want the first matching pattern to win", got)
+	}
+	for _, value := range []string{"golang.org/x/(.*)", "=v/$1", "golang.org/x/(.*=v/$1"} {
+		if err := parseRewritePatterns([]string{value}); err == nil {
+			t.Errorf("%q parsed", value)
+		}
+	}
+}
+
+func TestPatternRewriteOnlyVendorized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendorize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p []rewritePattern, c map[string]*build.Package) { rewritePatterns, claimed = p, c }(rewritePatterns, claimed)
+	rewritePatterns = nil
+	if err := parseRewritePatterns([]string{"(.*)=v/$1"}); err != nil {
+		t.Fatal(err)
+	}
+	// only example.com/dep was vendorized; fmt is in GOROOT and example.com/skip blacklisted
+	claimed = map[string]*build.Package{"v/example.com/dep": {ImportPath: "example.com/dep"}}
+
+	path := filepath.Join(dir, "a.go")
+	src := "package a\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/dep\"\n\t\"example.com/skip\"\n)\n\nvar _, _, _ = fmt.Sprint, dep.X, skip.X\n"
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, changed, err := rewriteFileImports(path, "", nil, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !changed {
+		t.Errorf("rewrote %d imports (changed %v), want 1", n, changed)
+	}
+	got := buf.String()
+	for _, want := range []string{`"fmt"`, `"v/example.com/dep"`, `"example.com/skip"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("the rewritten file is missing %s:\n%s", want, got)
+		}
+	}
+}
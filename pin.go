@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// pinnedRepo is a repository checked out at the version asked for with -at, in a clone
+// made for the run so that the user's checkout is left alone.
+type pinnedRepo struct {
+	prefix  string // import path of the repository root
+	version string
+	pins    []string // import paths given with -at that the repository holds
+	rev     string   // revision checked out
+}
+
+var (
+	pinRoot     string                         // temporary GOPATH entry holding the clones, first in the GOPATH packages are resolved in
+	pinnedRepos = make(map[string]*pinnedRepo) // by import path of the repository root
+)
+
+// clones the repository of every package given with -at and checks out the version asked
+// for, so that every package of those repositories is resolved, and vendorized, from the
+// clone. Repositories are cloned once, and two packages of one repository can't be pinned
+// to different versions.
+func setupPins() error {
+	if len(pins) == 0 {
+		return nil
+	}
+	if fromGolist != "" {
+		return fmt.Errorf("-at can't be used with -from-golist: go list already resolved the packages")
+	}
+	dir, err := ioutil.TempDir("", "vendorize-at-")
+	if err != nil {
+		return err
+	}
+	pinRoot = canonicalPath(dir)
+
+	for _, pin := range pins {
+		i := strings.Index(pin, "=")
+		if i < 0 || strings.TrimSpace(pin[i+1:]) == "" {
+			return fmt.Errorf("Invalid -at %q: expected importpath=version", pin)
+		}
+		path, version := strings.TrimSpace(pin[:i]), strings.TrimSpace(pin[i+1:])
+		if err := validImportPath(path); err != nil {
+			return fmt.Errorf("Invalid -at %q: %s", pin, err)
+		}
+		pkg, err := buildPackage(path)
+		if err != nil {
+			return fmt.Errorf("Couldn't import %s for -at: %s", path, err)
+		}
+		root := repoRoot(pkg)
+		rel, err := filepath.Rel(canonicalPath(filepath.Join(pkg.Root, "src")), root)
+		if err != nil || pkg.Root == "" || strings.HasPrefix(rel, "..") || (!isVCSRoot(root, ".git") && !isVCSRoot(root, ".hg")) {
+			return fmt.Errorf("Can't check out %s at %s: %q isn't in a git or hg repository under GOPATH", path, version, pkg.Dir)
+		}
+		prefix := filepath.ToSlash(rel)
+		if repo, ok := pinnedRepos[prefix]; ok {
+			if repo.version != version {
+				return fmt.Errorf("%s and %s are both in repository %s, but are pinned to %s and %s", repo.pins[0], path, prefix, repo.version, version)
+			}
+			repo.pins = append(repo.pins, path)
+			continue
+		}
+		repo := &pinnedRepo{prefix: prefix, version: version, pins: []string{path}}
+		if err := checkoutPin(root, filepath.Join(pinRoot, "src", rel), version); err != nil {
+			return fmt.Errorf("Couldn't check out %s at %s: %s", prefix, version, err)
+		}
+		repo.rev = repoRevision(filepath.Join(pinRoot, "src", rel)).Rev
+		pinnedRepos[prefix] = repo
+		infof("Vendorizing repository %s at %s (%s), checked out in %q", prefix, version, repo.rev, filepath.Join(pinRoot, "src", rel))
+	}
+
+	// packages built so far were resolved from the original checkouts
+	mu.Lock()
+	builtPackages = nil
+	mu.Unlock()
+	return nil
+}
+
+// clones the repository at root into dir and checks out version there
+func checkoutPin(root, dir, version string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0770); err != nil {
+		return err
+	}
+	run := func(dir, name string, args ...string) error {
+		verbosef("Running %s %s", name, strings.Join(args, " "))
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %s: %s: %s", name, args[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if isVCSRoot(root, ".hg") {
+		return run(root, "hg", "clone", "--quiet", "--updaterev", version, root, dir)
+	}
+	if err := run(root, "git", "clone", "--quiet", "--no-checkout", root, dir); err != nil {
+		return err
+	}
+	if run(dir, "git", "rev-parse", "--verify", "--quiet", version+"^{commit}") != nil {
+		return fmt.Errorf("no tag or revision %s", version)
+	}
+	return run(dir, "git", "checkout", "--quiet", "--detach", version+"^{commit}")
+}
+
+// warns about the packages given with -at that were never imported
+func reportPins() {
+	for _, repo := range pinnedRepos {
+		for _, path := range repo.pins {
+			if !visited[path] {
+				infof("Warning: -at package %s was never imported", path)
+			}
+		}
+	}
+}
+
+// removes the clones made for -at
+func removePins() {
+	if pinRoot == "" {
+		return
+	}
+	if err := os.RemoveAll(pinRoot); err != nil {
+		errorf("Couldn't remove the clones made for -at in %q: %s", pinRoot, err)
+	}
+}
+
+// logs like log.Fatalf and exits, removing the clones made for -at first, since exiting
+// skips the deferred removal
+func fatalf(format string, v ...interface{}) {
+	removePins()
+	log.Fatalf(format, v...)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checks that copying pkg into dir won't leave it holding Go files of two different packages.
+// Files that will be overwritten by the copy don't count. firstDir is the source dir of the
+// package copied into dir earlier in this run, if any.
+func checkPackageName(dir string, pkg *build.Package, firstDir string) error {
+	entries, err := readDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fset := token.NewFileSet()
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ok, _ := exists(filepath.Join(pkg.Dir, name)); ok {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		src, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		f, err := parser.ParseFile(fset, path, src, parser.PackageClauseOnly)
+		if err != nil {
+			continue
+		}
+		if other := f.Name.Name; other != pkg.Name && other != "documentation" {
+			return fmt.Errorf("%q already holds package %s in %s, %s, so package %s from %s (%q) can't be copied there",
+				dir, other, name, copiedFrom(firstDir), pkg.Name, pkg.ImportPath, pkg.Dir)
+		}
+	}
+	return nil
+}
+
+// describes where the package copied from srcDir earlier in this run came from
+func copiedFrom(srcDir string) string {
+	if srcDir == "" {
+		return "which this run didn't copy"
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, pkg := range claimed {
+		if pkg.Dir == srcDir {
+			return fmt.Sprintf("copied from %s (%q)", pkg.ImportPath, srcDir)
+		}
+	}
+	return fmt.Sprintf("copied from %q", srcDir)
+}
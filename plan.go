@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// planAction is a change to the file system a dry run would have made.
+type planAction struct {
+	Action string `json:"action"` // mkdir, copy, symlink, rewrite, rename, remove or write
+	Path   string `json:"path"`
+	Src    string `json:"src,omitempty"` // the file copied or renamed to path, or the directory it links to
+}
+
+// plan holds the actions of a dry run, for -plan-json and -dump-tree, in the order they
+// were performed.
+var plan []planAction
+
+// records an action of a dry run
+func planned(action, path, src string) {
+	if planFile == "" && !dumpTree || !dry {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	plan = append(plan, planAction{Action: action, Path: path, Src: src})
+}
+
+// writes the recorded actions to path as a JSON array, sorted by path so that the plan
+// doesn't depend on the order packages were vendorized in
+func writePlan(path string) error {
+	sorted := append([]planAction(nil), plan...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Path != sorted[j].Path {
+			return sorted[i].Path < sorted[j].Path
+		}
+		return actionOrder[sorted[i].Action] < actionOrder[sorted[j].Action]
+	})
+	data, err := json.MarshalIndent(sorted, "", "\t")
+	if err != nil {
+		return err
+	}
+	// the plan is the dry run's output, so it is written even though nothing else is
+	return replaceFile(path, 0660, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// actionOrder orders the actions on a single path as they would happen.
+var actionOrder = map[string]int{"rename": 0, "remove": 1, "mkdir": 2, "copy": 3, "symlink": 3, "write": 4, "rewrite": 5}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// checks that -plugin-packages and -tags combine with the other flags
+func checkPluginPackages() error {
+	if pluginPackages && noIgnoredFiles {
+		return fmt.Errorf("-plugin-packages can't be used with -no-ignored-files")
+	}
+	if buildTags != "" && fromGolist != "" {
+		return fmt.Errorf("-tags can't be used with -from-golist: go list already applied its own tags")
+	}
+	return nil
+}
+
+// returns the build tags given with -tags
+func splitBuildTags() []string {
+	var tags []string
+	for _, tag := range strings.Split(buildTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// returns the imports of the files in pkg excluded by build constraints, along with the
+// subset imported by files that aren't tests. With prodOnly, test files are left out.
+func constrainedImports(pkg *build.Package) (imports []string, nonTest map[string]bool, err error) {
+	seen := make(map[string]bool)
+	nonTest = make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, file := range pkg.IgnoredGoFiles {
+		test := strings.HasSuffix(file, "_test.go")
+		if test && prodOnly {
+			continue
+		}
+		path := filepath.Join(pkg.Dir, file)
+		src, err := readFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		f, err := parser.ParseFile(fset, path, src, parser.ImportsOnly)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, spec := range f.Imports {
+			imp, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid import %s", path, spec.Path.Value)
+			}
+			if !test {
+				nonTest[imp] = true
+			}
+			if !seen[imp] {
+				seen[imp] = true
+				imports = append(imports, imp)
+			}
+		}
+	}
+	return imports, nonTest, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// checks, without copying or rewriting anything, that a run vendorizing roots into dest
+// can succeed: that what it writes to is writable and that every package in the
+// dependency graph can be imported. Every problem found is logged, and their number is
+// returned.
+func preflight(roots []string, dest string) int {
+	var problems []string
+
+	target := filepath.Join(gopath, "src", dest)
+	if archive != "" {
+		target = filepath.Dir(archive)
+	}
+	if err := checkWritable(target); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	resolved := 0
+	seen := make(map[string]bool)
+	queue := append([]string(nil), roots...)
+	for _, path := range queue {
+		seen[path] = true
+	}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		pkg, err := buildPackage(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Couldn't import %s: %s", path, err))
+			continue
+		}
+		if pkg.Goroot && !gorootAllowed(path) {
+			// only roots can be, as imports from GOROOT aren't queued unless -allow-goroot
+			problems = append(problems, fmt.Sprintf("Can't vendorize %s: it is in GOROOT", path))
+			continue
+		}
+		verbosef("Resolved %s to %q", path, pkg.Dir)
+		resolved++
+		imports := getAllImports(pkg)
+		if pluginPackages {
+			constrained, _, err := constrainedImports(pkg)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Couldn't read the imports of %s: %s", path, err))
+			}
+			imports = append(imports, constrained...)
+		}
+		sort.Strings(imports)
+		for _, imp := range imports {
+			if imp == "C" || seen[imp] {
+				continue
+			}
+			seen[imp] = true
+			dep, err := buildPackage(imp)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: couldn't import %s: %s", path, imp, err))
+				continue
+			}
+			if !dep.Goroot || gorootAllowed(imp) {
+				queue = append(queue, imp)
+			}
+		}
+	}
+
+	for _, problem := range problems {
+		errorf("%s", problem)
+	}
+	if len(problems) == 0 {
+		infof("Preflight found no problems with the %d packages to vendorize", resolved)
+	}
+	return len(problems)
+}
+
+// checks that dir, or the nearest of its parents that exists if it doesn't yet, is a
+// directory files can be created in. The only way to know for sure is to try, so a
+// temp file is created there through fsys and removed at once.
+func checkWritable(dir string) error {
+	existing := dir
+	for {
+		info, err := fsys.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("Can't write to %q: %q isn't a directory", dir, existing)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("Can't write to %q: %s", dir, err)
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return fmt.Errorf("Can't write to %q: no parent directory exists", dir)
+		}
+		existing = parent
+	}
+	f, err := fsys.TempFile(existing, ".vendorize-preflight")
+	if err != nil {
+		return fmt.Errorf("Can't write to %q: %s", dir, err)
+	}
+	f.Close()
+	return fsys.Remove(f.Name())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// projectFiles is the number of Go files queued from -update-all-imports-in-root, and
+// projectChanged how many of them had imports rewritten.
+var projectFiles, projectChanged int
+
+// queues every Go file under the project directory root for rewriting in place, leaving
+// out the destination, version control metadata, testdata and the directories the go
+// tool ignores, those starting with a dot or an underscore, as well as files already
+// queued as part of a visited package and, with -rewrite-tests=false, test files
+func queueProjectFiles(root, dest string) error {
+	root = canonicalPath(root)
+	destDir := canonicalPath(filepath.Join(gopath, "src", dest))
+	queued := make(map[string]bool)
+	mu.Lock()
+	for _, job := range pendingRewrites {
+		queued[job.dest] = true
+	}
+	mu.Unlock()
+
+	return fsys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != root && (path == destDir || vcsDirs[name] || name == "testdata" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, ".go") || queued[path] || !rewriteTests && strings.HasSuffix(name, "_test.go") {
+			return nil
+		}
+		mu.Lock()
+		pendingRewrites = append(pendingRewrites, rewriteJob{pkg: projectPackage(filepath.Dir(path)), dest: path, src: path, project: true})
+		mu.Unlock()
+		projectFiles++
+		return nil
+	})
+}
+
+// returns the import path of the project directory dir, if it is in a GOPATH entry, or
+// dir itself
+func projectPackage(dir string) string {
+	for _, entry := range filepath.SplitList(goEnv("GOPATH")) {
+		src := canonicalPath(filepath.Join(entry, "src"))
+		if rel, err := filepath.Rel(src, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return dir
+}
+
+// logs how many of the project's files had imports rewritten
+func reportProject() {
+	if dry {
+		infof("Would rewrite the imports of the %d other Go files of %q as needed", projectFiles, updateRoot)
+		return
+	}
+	infof("Rewrote imports in %d of the %d other Go files of %q", projectChanged, projectFiles, updateRoot)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// goModReplace is a replace directive of a go.mod file.
+type goModReplace struct {
+	old string // module path being replaced
+	new string // module path or directory it is replaced with
+	dir bool   // whether new is a directory
+}
+
+// goModReplaces are the replace directives honored with -dereference-replace, longest
+// module path first.
+var goModReplaces []goModReplace
+
+// finds the go.mod file governing dir by looking in dir and its parents
+func findGoMod(dir string) (string, bool) {
+	for {
+		file := filepath.Join(dir, "go.mod")
+		if ok, _ := exists(file); ok {
+			return file, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// calls fn with the fields of every directive of the go.mod file at path using verb,
+// whether given on its own line or in a block, leaving out the verb and any comment
+func scanGoMod(path, verb string, fn func(line int, fields []string) error) error {
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	inBlock := false
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		switch {
+		case len(fields) == 0:
+			continue
+		case inBlock && fields[0] == ")":
+			inBlock = false
+			continue
+		case inBlock:
+		case fields[0] == verb && len(fields) == 2 && fields[1] == "(":
+			inBlock = true
+			continue
+		case fields[0] == verb:
+			fields = fields[1:]
+		default:
+			continue
+		}
+		if err := fn(line, fields); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// reads the replace directives of the go.mod file at path into goModReplaces.
+// Relative directories are resolved against the directory of the go.mod file.
+func loadGoModReplaces(path string) error {
+	err := scanGoMod(path, "replace", func(line int, fields []string) error {
+		arrow := -1
+		for i, field := range fields {
+			if field == "=>" {
+				arrow = i
+			}
+		}
+		if arrow < 1 || arrow > 2 || len(fields)-arrow < 2 || len(fields)-arrow > 3 {
+			return fmt.Errorf("%s:%d: malformed replace directive", path, line)
+		}
+		r := goModReplace{old: fields[0], new: fields[arrow+1]}
+		if strings.HasPrefix(r.new, "./") || strings.HasPrefix(r.new, "../") || filepath.IsAbs(r.new) {
+			if !filepath.IsAbs(r.new) {
+				r.new = filepath.Join(filepath.Dir(path), r.new)
+			}
+			r.dir = true
+		}
+		goModReplaces = append(goModReplaces, r)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(goModReplaces, func(i, j int) bool {
+		return len(goModReplaces[i].old) > len(goModReplaces[j].old)
+	})
+	return nil
+}
+
+// returns what the package at path is resolved to under the replace directives: a
+// directory when dir is true, or else another import path
+func replacedImport(path string) (target string, dir bool, ok bool) {
+	for _, r := range goModReplaces {
+		if path != r.old && !strings.HasPrefix(path, r.old+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(path, r.old)
+		if r.dir {
+			return filepath.Join(r.new, filepath.FromSlash(rest)), true, true
+		}
+		return r.new + rest, false, true
+	}
+	return "", false, false
+}
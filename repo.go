@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"path/filepath"
+	"strings"
+)
+
+// vcsDirs are the names of version control metadata directories.
+var vcsDirs = map[string]bool{".git": true, ".hg": true, ".svn": true, ".bzr": true}
+
+// copiedRepos are the repository roots copied by copyRepo, so each is only copied once.
+var copiedRepos = make(map[string]bool)
+
+// returns the root directory of the repository holding pkg, found by looking for version
+// control metadata between the package directory and its GOPATH src directory. Without
+// metadata, the package directory itself is the root.
+func repoRoot(pkg *build.Package) string {
+	srcRoot := canonicalPath(filepath.Join(pkg.Root, "src"))
+	for dir := pkg.Dir; dir != srcRoot && strings.HasPrefix(dir, srcRoot+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		for vcs := range vcsDirs {
+			if ok, _ := exists(filepath.Join(dir, vcs)); ok {
+				return dir
+			}
+		}
+	}
+	return pkg.Dir
+}
+
+// reports whether the repository holding pkg has been copied in this run
+func repoCopied(pkg *build.Package) bool {
+	root := repoRoot(pkg)
+	mu.Lock()
+	defer mu.Unlock()
+	return copiedRepos[root]
+}
+
+// copies the whole repository holding pkg so that pkg lands in pkgDir, preserving the
+// repository's directory layout around it, and counts the files copied in m
+func copyRepo(pkgDir string, pkg *build.Package, m *packageMetrics) error {
+	root := repoRoot(pkg)
+	rel, err := filepath.Rel(root, pkg.Dir)
+	if err != nil {
+		return err
+	}
+	destRoot := pkgDir
+	if rel != "." {
+		if !strings.HasSuffix(pkgDir, string(filepath.Separator)+rel) {
+			return fmt.Errorf("Can't preserve the layout of %q: vendored path %q doesn't end in %q", root, pkgDir, rel)
+		}
+		destRoot = strings.TrimSuffix(pkgDir, string(filepath.Separator)+rel)
+	}
+
+	mu.Lock()
+	copied := copiedRepos[root]
+	copiedRepos[root] = true
+	mu.Unlock()
+	if copied {
+		verbosef("Repository %q of %s already copied", root, pkg.ImportPath)
+		return nil
+	}
+
+	exclude := make(map[string]bool)
+	for file := range excludedFiles(pkg) {
+		exclude[filepath.Join(rel, file)] = true
+	}
+	return copyTree(destRoot, root, exclude, m)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// rewriteJob is a file whose imports are to be rewritten once all packages are vendorized.
+type rewriteJob struct {
+	pkg     string // import path of the package the file belongs to
+	dest    string // file to write
+	src     string // file to read
+	text    bool   // whether import paths are replaced as plain text rather than in import statements
+	project bool   // whether the file was queued by -update-all-imports-in-root
+	lenient bool   // whether the file only might be Go source, having a -rewrite-ext extension
+}
+
+// pendingRewrites are the files queued for rewriting.
+var pendingRewrites []rewriteJob
+
+// rewriteCount is how many import statements were rewritten in how many files of a package.
+type rewriteCount struct {
+	imports int
+	files   int
+}
+
+// rewriteCounts maps the import paths of packages to the import statements rewritten in them.
+var rewriteCounts = make(map[string]*rewriteCount)
+
+// queues the file src of pkg to be rewritten to dest
+func queueRewrite(pkg, dest, src string) {
+	mu.Lock()
+	defer mu.Unlock()
+	pendingRewrites = append(pendingRewrites, rewriteJob{pkg: pkg, dest: dest, src: src})
+}
+
+// queues the file src of pkg to have the import paths in it replaced as plain text, to dest
+func queueTextRewrite(pkg, dest, src string) {
+	mu.Lock()
+	defer mu.Unlock()
+	pendingRewrites = append(pendingRewrites, rewriteJob{pkg: pkg, dest: dest, src: src, text: true})
+}
+
+// rewrites the imports of every queued file using all of the rewrites performed,
+// returning the number of packages that had a file fail to rewrite
+func rewriteAll() int {
+	m := copyRewrites()
+	if len(m) == 0 && len(rewritePatterns) == 0 {
+		return 0
+	}
+
+	sort.Slice(pendingRewrites, func(i, j int) bool {
+		return pendingRewrites[i].dest < pendingRewrites[j].dest
+	})
+	failed := make(map[string]bool)
+	var re *regexp.Regexp // compiled for the first textual rewrite
+	for _, job := range pendingRewrites {
+		if isInterrupted() {
+			break
+		}
+		if !rewriteAllowed(job.pkg) {
+			verbosef("Not rewriting imports in %q: %s isn't under -rewrite-only-prefix", job.dest, job.pkg)
+			continue
+		}
+		if vendoredCopyJob(job, m) {
+			verbosef("Not rewriting imports in %q: with -root-only-rewrite, vendorized copies keep the original import paths", job.dest)
+			continue
+		}
+		verbosef("Rewriting imports in %q", job.dest)
+		var err error
+		if job.text {
+			if len(m) == 0 {
+				// -rewrite-re patterns don't apply to plain text
+				continue
+			}
+			if re == nil {
+				re = importPathsRegexp(m)
+			}
+			err = rewriteText(job.dest, job.src, m, re)
+		} else {
+			var n int
+			n, err = rewriteFile(job.dest, job.src, canonicalPathFor(job, m), m)
+			if n > 0 {
+				recordRewriteCount(job.pkg, n)
+				if job.project {
+					projectChanged++
+				}
+			}
+		}
+		if err != nil && (job.lenient || skipUnparseable) && isParseError(err) {
+			infof("Warning: not rewriting %q: it isn't valid Go: %s", job.dest, err)
+			continue
+		}
+		if err != nil {
+			errorf("%s: couldn't rewrite file %q: %s", job.pkg, job.dest, err)
+			failed[job.pkg] = true
+		}
+	}
+
+	if len(pendingHooks) > 0 {
+		hookFailed := runHooks()
+		for _, job := range pendingRewrites {
+			if hookFailed[job.dest] {
+				failed[job.pkg] = true
+			}
+		}
+	}
+	return len(failed)
+}
+
+// returns the path the import comment of the file of job is rewritten to with
+// -rewrite-canonical-import-comment: the vendored path of its package, as long as the file
+// is part of the vendorized copy rather than of a package rewritten where it is
+func canonicalPathFor(job rewriteJob, m map[string]string) string {
+	newPath, ok := m[job.pkg]
+	if !rewriteCanonical || !ok {
+		return ""
+	}
+	if filepath.Dir(job.dest) != canonicalPath(filepath.Join(gopath, "src", filepath.FromSlash(newPath))) {
+		return ""
+	}
+	return newPath
+}
+
+// reports whether files of the package at path may be rewritten under -rewrite-only-prefix
+func rewriteAllowed(path string) bool {
+	if len(rewriteOnly) == 0 {
+		return true
+	}
+	for _, prefix := range rewriteOnly {
+		if hasPackagePrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// records that n import statements were rewritten in one file of the package at path
+func recordRewriteCount(path string, n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	c, ok := rewriteCounts[path]
+	if !ok {
+		c = &rewriteCount{}
+		rewriteCounts[path] = c
+	}
+	c.imports += n
+	c.files++
+}
+
+// logs how many import statements -u rewrote, or would have with -d, in each package,
+// sorted by import path
+func reportRewriteSummary() {
+	paths := make([]string, 0, len(rewriteCounts))
+	for path := range rewriteCounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	verb := "Rewrote"
+	if dry {
+		verb = "Would rewrite"
+	}
+	for _, path := range paths {
+		c := rewriteCounts[path]
+		infof("%s %d imports across %d files in package %s", verb, c.imports, c.files, path)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checks that -root-only-rewrite comes with something to rewrite
+func checkRootOnlyRewrite() error {
+	if rootOnlyRewrite && !updateImports {
+		return fmt.Errorf("-root-only-rewrite only applies with -u or -update-all-imports-in-root")
+	}
+	return nil
+}
+
+// reports whether dest is a vendor directory the go tool resolves the imports of pkg in:
+// one named vendor, in pkg or one of its parents
+func isGoVendorDir(dest, pkg string) bool {
+	if dest != "vendor" && !strings.HasSuffix(dest, "/vendor") {
+		return false
+	}
+	parent := strings.TrimSuffix(strings.TrimSuffix(dest, "vendor"), "/")
+	return parent == "" || hasPackagePrefix(pkg, parent)
+}
+
+// reports whether the file of job is left alone by -root-only-rewrite: it belongs to the
+// copy of a package vendorized in this run, which keeps importing the original paths
+func vendoredCopyJob(job rewriteJob, m map[string]string) bool {
+	if !rootOnlyRewrite {
+		return false
+	}
+	_, ok := m[job.pkg]
+	return ok
+}
+
+// with -root-only-rewrite, turns rewriting off altogether when dest is a vendor directory
+// of pkg: the original import paths of the root resolve to the vendorized copies already,
+// and the go tool rejects the vendored paths. Otherwise warns that the vendorized copies
+// get their imports from outside of dest.
+func setupRootOnlyRewrite(dest, pkg string) {
+	if !rootOnlyRewrite {
+		return
+	}
+	if isGoVendorDir(dest, pkg) {
+		infof("Not rewriting any imports: %s is a vendor directory of %s, so the original import paths resolve to the vendorized copies", dest, pkg)
+		updateImports, updateRoot = false, ""
+		return
+	}
+	infof("Warning: %s isn't a vendor directory of %s, so with -root-only-rewrite the original import paths of the vendorized copies resolve outside of it", dest, pkg)
+}
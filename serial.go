@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// serialFS is a FileSystem that hands every mutation of the underlying file system,
+// including writes to open files, to a single writer goroutine. Reads go straight
+// through, so the package graph is still walked concurrently.
+type serialFS struct {
+	fs  FileSystem
+	ops chan func()
+}
+
+// returns a serialFS over fs and starts its writer goroutine
+func newSerialFS(fs FileSystem) *serialFS {
+	s := &serialFS{fs: fs, ops: make(chan func())}
+	go func() {
+		for op := range s.ops {
+			op()
+		}
+	}()
+	return s
+}
+
+// reports whether fs reads straight from the operating system's file system, as osFS and
+// a serialFS over it do, so that go/build may be left to read it, and resolve modules
+func readsOS(fs FileSystem) bool {
+	switch fs := fs.(type) {
+	case osFS:
+		return true
+	case *serialFS:
+		return readsOS(fs.fs)
+	}
+	return false
+}
+
+// runs op on the writer goroutine and waits for it to finish
+func (s *serialFS) do(op func()) {
+	done := make(chan struct{})
+	s.ops <- func() {
+		op()
+		close(done)
+	}
+	<-done
+}
+
+func (s *serialFS) Open(name string) (File, error) {
+	return s.fs.Open(name)
+}
+
+func (s *serialFS) Create(name string, perm os.FileMode) (f File, err error) {
+	s.do(func() { f, err = s.fs.Create(name, perm) })
+	if err != nil {
+		return nil, err
+	}
+	return serialFile{f, s}, nil
+}
+
+func (s *serialFS) TempFile(dir, pattern string) (f File, err error) {
+	s.do(func() { f, err = s.fs.TempFile(dir, pattern) })
+	if err != nil {
+		return nil, err
+	}
+	return serialFile{f, s}, nil
+}
+
+func (s *serialFS) Stat(name string) (os.FileInfo, error) {
+	return s.fs.Stat(name)
+}
+
+func (s *serialFS) MkdirAll(path string, perm os.FileMode) (err error) {
+	s.do(func() { err = s.fs.MkdirAll(path, perm) })
+	return err
+}
+
+func (s *serialFS) Walk(root string, fn filepath.WalkFunc) error {
+	return s.fs.Walk(root, fn)
+}
+
+func (s *serialFS) Rename(oldpath, newpath string) (err error) {
+	s.do(func() { err = s.fs.Rename(oldpath, newpath) })
+	return err
+}
+
+func (s *serialFS) Remove(name string) (err error) {
+	s.do(func() { err = s.fs.Remove(name) })
+	return err
+}
+
+func (s *serialFS) Chtimes(name string, mtime time.Time) (err error) {
+	s.do(func() { err = s.fs.Chtimes(name, mtime) })
+	return err
+}
+
+func (s *serialFS) Symlink(oldname, newname string) (err error) {
+	s.do(func() { err = s.fs.Symlink(oldname, newname) })
+	return err
+}
+
+func (s *serialFS) Link(oldname, newname string) (err error) {
+	s.do(func() { err = s.fs.Link(oldname, newname) })
+	return err
+}
+
+// serialFile is a file created through a serialFS. Its writes also go through the
+// writer goroutine.
+type serialFile struct {
+	File
+	s *serialFS
+}
+
+func (f serialFile) Write(p []byte) (n int, err error) {
+	f.s.do(func() { n, err = f.File.Write(p) })
+	return n, err
+}
+
+func (f serialFile) Chmod(mode os.FileMode) (err error) {
+	f.s.do(func() { err = f.File.Chmod(mode) })
+	return err
+}
+
+func (f serialFile) Close() (err error) {
+	f.s.do(func() { err = f.File.Close() })
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"go/build"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	sourceModCache  = "modcache"  // the package was copied from the module cache
+	sourceWorkspace = "workspace" // the package was copied from a GOPATH workspace or -src-root
+)
+
+// packageSources maps the import paths of vendorized packages to where they were copied
+// from, with -flag-cache-source. Only touched by the loop draining the results.
+var packageSources = make(map[string]string)
+
+// returns the module cache directories packages can be resolved in: GOMODCACHE, and the
+// pkg/mod directory of every GOPATH entry
+func modCacheDirs() []string {
+	var dirs []string
+	if dir := goEnv("GOMODCACHE"); dir != "" {
+		dirs = append(dirs, canonicalPath(dir))
+	}
+	for _, entry := range filepath.SplitList(goEnv("GOPATH")) {
+		if entry != "" {
+			dirs = append(dirs, canonicalPath(filepath.Join(entry, "pkg", "mod")))
+		}
+	}
+	return dirs
+}
+
+// logs and returns whether pkg is copied from the module cache or from a workspace
+func packageSource(pkg *build.Package) string {
+	source := sourceWorkspace
+	for _, dir := range modCacheDirs() {
+		if strings.HasPrefix(pkg.Dir, dir+string(filepath.Separator)) {
+			source = sourceModCache
+			break
+		}
+	}
+	if source == sourceModCache {
+		infof("%s comes from the module cache at %q", pkg.ImportPath, pkg.Dir)
+	} else {
+		verbosef("%s comes from the workspace at %q", pkg.ImportPath, pkg.Dir)
+	}
+	return source
+}
+
+// logs how many of the vendorized packages came from the module cache and from a
+// workspace, listing those from the module cache
+func reportSources() {
+	var cached []string
+	for path, source := range packageSources {
+		if source == sourceModCache {
+			cached = append(cached, path)
+		}
+	}
+	sort.Strings(cached)
+	infof("Vendorized %d packages from the module cache and %d from a workspace",
+		len(cached), len(packageSources)-len(cached))
+	for _, path := range cached {
+		infof("  %s", path)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// specVersion identifies the variant of the Godeps.json format written by -vendor-spec.
+// It is bumped whenever the fields written change.
+const specVersion = "vendorize-2"
+
+// godeps is the Godeps.json document written by -vendor-spec.
+type godeps struct {
+	ImportPath   string
+	GoVersion    string
+	GodepVersion string
+	Deps         []godep
+}
+
+// godep is a vendorized package in a Godeps.json document.
+type godep struct {
+	ImportPath string
+	Comment    string `json:",omitempty"`
+	Rev        string
+	Source     string `json:",omitempty"` // sourceModCache or sourceWorkspace, with -flag-cache-source
+}
+
+// writes the packages vendorized as the dependencies of pkgName to path in the Godeps.json
+// format, each with the revision its repository was at. Packages vendorized in this run had
+// theirs read as they were copied; those of earlier runs are read now. pkgName and the
+// packages under it aren't dependencies of it, so they are left out.
+func writeVendorSpec(path, pkgName string) error {
+	spec := godeps{ImportPath: pkgName, GoVersion: runtime.Version(), GodepVersion: specVersion, Deps: []godep{}}
+	revs := make(map[string]godep) // by repository root
+	for importPath := range copyRewrites() {
+		if hasPackagePrefix(importPath, pkgName) {
+			continue
+		}
+		if m, ok := vendoredMetrics[importPath]; ok {
+			dep := m.rev
+			dep.ImportPath = importPath
+			dep.Source = packageSources[importPath]
+			spec.Deps = append(spec.Deps, dep)
+			continue
+		}
+		pkg, err := buildPackage(importPath)
+		if err != nil {
+			// vendorized by an earlier run, and gone from GOPATH since
+			infof("Warning: leaving %s out of the vendor spec: %s", importPath, err)
+			continue
+		}
+		root := repoRoot(pkg)
+		dep, ok := revs[root]
+		if !ok {
+			dep = repoRevision(root)
+			if dep.Rev == "" {
+				infof("Warning: no revision found for %s in %q", importPath, root)
+			}
+			revs[root] = dep
+		}
+		dep.ImportPath = importPath
+		dep.Source = packageSources[importPath]
+		spec.Deps = append(spec.Deps, dep)
+	}
+	sort.Slice(spec.Deps, func(i, j int) bool {
+		return spec.Deps[i].ImportPath < spec.Deps[j].ImportPath
+	})
+
+	data, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return err
+	}
+	verbosef("Writing vendor spec to %q", path)
+	if dry {
+		return nil
+	}
+	return replaceFile(path, 0660, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// returns the revision checked out in the repository at root, and for git a description
+// of it relative to the closest tag, or an empty revision if it can't be told
+func repoRevision(root string) godep {
+	output := func(name string, args ...string) string {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = root
+		out, err := cmd.Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+	switch {
+	case isVCSRoot(root, ".git"):
+		return godep{Rev: output("git", "rev-parse", "HEAD"), Comment: output("git", "describe", "--tags")}
+	case isVCSRoot(root, ".hg"):
+		return godep{Rev: output("hg", "id", "--id", "--debug")}
+	}
+	return godep{}
+}
+
+// reports whether root holds the metadata of the version control system using vcs
+func isVCSRoot(root, vcs string) bool {
+	ok, _ := exists(filepath.Join(root, vcs))
+	return ok
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// checks that every -src-root is laid out like a GOPATH entry and that the flag combines
+// with the others, making the roots canonical
+func checkSrcRoots() error {
+	if len(srcRoots) > 0 && fromGolist != "" {
+		return fmt.Errorf("-src-root can't be used with -from-golist: go list already resolved the packages")
+	}
+	for i, root := range srcRoots {
+		root = canonicalPath(root)
+		info, err := fsys.Stat(filepath.Join(root, "src"))
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("Invalid -src-root %q: it has no src directory", root)
+		}
+		srcRoots[i] = root
+	}
+	return nil
+}
+
+// returns the GOPATH packages are resolved in: the GOPATH entries followed by the roots
+// given with -src-root, so that a package in both is found in GOPATH. Packages are only
+// ever copied into GOPATH, never into a -src-root. The clones made for -at come first, so
+// that the repositories they hold are resolved from them.
+func resolveGOPATH() string {
+	var entries []string
+	if pinRoot != "" {
+		entries = append(entries, pinRoot)
+	}
+	for _, entry := range filepath.SplitList(goEnv("GOPATH")) {
+		entries = append(entries, canonicalPath(entry))
+	}
+	entries = append(entries, srcRoots...)
+	return strings.Join(entries, string(filepath.ListSeparator))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+)
+
+// vendorState is the state of previous runs kept in the -state file.
+type vendorState struct {
+	Dest     string            `json:"dest"`
+	Rewrites map[string]string `json:"rewrites"` // original import paths mapped to their vendored paths
+}
+
+// priorRewrites are the rewrites performed by previous runs, as read from the state file.
+var priorRewrites = make(map[string]string)
+
+// priorOrigins maps the import paths packages were vendorized to under the destination
+// recorded in the state file, when it differs from the destination of this run, back
+// to their original import paths.
+var priorOrigins = make(map[string]string)
+
+// reads the state file at path into priorRewrites. A missing file is an empty state.
+// If the state was saved for a destination other than dest, the packages vendorized
+// there are remembered in priorOrigins instead, since they have to be vendorized again
+// under dest.
+func loadState(path, dest string) error {
+	data, err := readFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state vendorState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	moved := state.Dest != "" && state.Dest != dest
+	for k, v := range state.Rewrites {
+		if moved && strings.HasPrefix(v, state.Dest+"/") {
+			priorOrigins[v] = k
+			continue
+		}
+		priorRewrites[k] = v
+	}
+	return nil
+}
+
+// returns the original import path of path if path was vendorized into the destination
+// of a previous run
+func priorVendored(path string) (string, bool) {
+	orig, ok := priorOrigins[path]
+	return orig, ok
+}
+
+// writes the prior rewrites merged with the ones performed in this run to the state file at path
+func saveState(path, dest string) error {
+	state := vendorState{Dest: dest, Rewrites: copyRewrites()}
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	verbosef("Writing state to %q", path)
+	if dry {
+		return nil
+	}
+	return replaceFile(path, 0660, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// linkedDir is a symbolic link in the destination made with -follow-symlinked-packages=false.
+type linkedDir struct {
+	target  string // directory linked to
+	earlier bool   // whether the link was made by an earlier run
+}
+
+// linkedDirs are the links in the destination packages are vendorized by. Guarded by mu.
+var linkedDirs = make(map[string]linkedDir)
+
+// checks that -follow-symlinked-packages fits the other flags
+func checkFollowSymlinks() error {
+	if !followSymlinks && archive != "" {
+		return fmt.Errorf("-archive can't be used with -follow-symlinked-packages=false: archives hold no links")
+	}
+	return nil
+}
+
+// returns the outermost symbolic link the directory of pkg is reached through below its
+// GOPATH src directory, along with the import path the link is at, or empty strings if
+// there is none. go/build resolves packages under their import path, and pkg.Dir has its
+// links resolved since, so the path is rebuilt from the import path.
+func symlinkedDir(pkg *build.Package) (link, linkPath string) {
+	if pkg.Root == "" || pkg.Goroot {
+		return "", ""
+	}
+	src := filepath.Join(pkg.Root, "src")
+	if canonicalPath(filepath.Join(src, filepath.FromSlash(pkg.ImportPath))) != pkg.Dir {
+		// resolved elsewhere, like through a replace directive
+		return "", ""
+	}
+	dir := src
+	for _, elem := range strings.Split(pkg.ImportPath, "/") {
+		dir = filepath.Join(dir, elem)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return "", ""
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			rel, _ := filepath.Rel(src, dir)
+			return dir, filepath.ToSlash(rel)
+		}
+	}
+	return "", ""
+}
+
+// puts pkg in pkgDir by linking to the directory the symbolic link it is reached through
+// points to, rather than by copying it, with -follow-symlinked-packages=false. The link is
+// made where that symbolic link is, relative to pkgDir, so the packages below it are all
+// vendorized by the one link, whichever of them comes first. It returns the link, and
+// whether it was left by an earlier run.
+func linkPackage(pkgDir string, pkg *build.Package, link, linkPath string) (string, bool, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(pkg.ImportPath), linkPath), "/")
+	linkDest := pkgDir
+	if rel != "" {
+		suffix := string(filepath.Separator) + filepath.FromSlash(rel)
+		if !strings.HasSuffix(pkgDir, suffix) {
+			return "", false, fmt.Errorf("Can't preserve the link %q: vendored path %q doesn't end in %q", link, pkgDir, rel)
+		}
+		linkDest = strings.TrimSuffix(pkgDir, suffix)
+	}
+	target := canonicalPath(link)
+
+	// the link is claimed by the first of its packages, which goes on to make it
+	mu.Lock()
+	linked, ok := linkedDirs[linkDest]
+	if !ok {
+		linked = linkedDir{target: target, earlier: canonicalPath(linkDest) == target}
+		linkedDirs[linkDest] = linked
+	}
+	mu.Unlock()
+	if ok || linked.earlier {
+		if linked.target != target {
+			return "", false, fmt.Errorf("Couldn't link %q to %q: it is linked to %q", linkDest, target, linked.target)
+		}
+		verbosef("%s is already linked through %q", pkg.ImportPath, linkDest)
+		return linkDest, linked.earlier, nil
+	}
+
+	if info, err := os.Lstat(linkDest); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 || !forceUpdates {
+			return "", false, fmt.Errorf("Couldn't link %q to %q: it already exists", linkDest, target)
+		}
+		planned("remove", linkDest, "")
+		if !dry {
+			if err := fsys.Remove(linkDest); err != nil {
+				return "", false, err
+			}
+		}
+	}
+	verbosef("Linking %q to %q, as %q is a symbolic link", linkDest, target, link)
+	planned("mkdir", filepath.Dir(linkDest), "")
+	planned("symlink", linkDest, target)
+	if dry {
+		return linkDest, false, nil
+	}
+	if err := fsys.MkdirAll(filepath.Dir(linkDest), 0770); err != nil {
+		return "", false, err
+	}
+	return linkDest, false, fsys.Symlink(target, linkDest)
+}
+
+// reports whether path is a symbolic link made with -follow-symlinked-packages=false
+func isLinkedDir(path string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := linkedDirs[path]
+	return ok
+}
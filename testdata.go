@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"go/build"
+	"path/filepath"
+)
+
+// reports whether any test file of pkg mentions a testdata directory beside it
+func usesTestdata(pkg *build.Package) bool {
+	if ok, _ := exists(filepath.Join(pkg.Dir, "testdata")); !ok {
+		return false
+	}
+	for _, files := range [][]string{pkg.TestGoFiles, pkg.XTestGoFiles} {
+		for _, file := range files {
+			data, err := readFile(filepath.Join(pkg.Dir, file))
+			if err != nil {
+				continue
+			}
+			if bytes.Contains(data, []byte("testdata")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copies the testdata directory of pkg into pkgDir, so that the vendorized tests can
+// still find their fixtures. Nothing in it is excluded. The files copied are counted in m.
+func copyTestdata(pkgDir string, pkg *build.Package, m *packageMetrics) error {
+	return copyTree(filepath.Join(pkgDir, "testdata"), filepath.Join(pkg.Dir, "testdata"), nil, m)
+}
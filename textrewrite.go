@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// checks that every -rewrite-glob is a valid pattern
+func checkRewriteGlobs() error {
+	for _, pattern := range rewriteGlobs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid -rewrite-glob %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// returns the names of the files in dir, other than Go files and those rewritten as Go
+// source for -rewrite-ext, that match a -rewrite-glob pattern
+func textRewriteFiles(dir string) ([]string, error) {
+	if len(rewriteGlobs) == 0 {
+		return nil, nil
+	}
+	entries, err := readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, ".go") || hasRewriteExt(name) {
+			continue
+		}
+		for _, pattern := range rewriteGlobs {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				files = append(files, name)
+				break
+			}
+		}
+	}
+	return files, nil
+}
+
+// returns a regular expression matching any of the import paths rewritten by m, longest
+// first so that the longest path wins where one is a prefix of another
+func importPathsRegexp(m map[string]string) *regexp.Regexp {
+	paths := make([]string, 0, len(m))
+	for path := range m {
+		paths = append(paths, regexp.QuoteMeta(path))
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i]) != len(paths[j]) {
+			return len(paths[i]) > len(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+	return regexp.MustCompile(strings.Join(paths, "|"))
+}
+
+// reports whether c can be part of an import path
+func isImportPathByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~+/", c) >= 0
+}
+
+// rewrites the file at path textually: every occurrence of an import path the rewrites
+// in m apply to is replaced, as long as it stands on its own rather than being part of a
+// longer path, such as a subpackage or one already rewritten into the destination
+func rewriteText(dest, path string, m map[string]string, re *regexp.Regexp) error {
+	return rewriteWith(dest, path, func(buf *bytes.Buffer) (bool, error) {
+		src, err := readFile(path)
+		if err != nil {
+			return false, err
+		}
+		changed := false
+		last := 0
+		for _, loc := range re.FindAllIndex(src, -1) {
+			start, end := loc[0], loc[1]
+			if start > 0 && isImportPathByte(src[start-1]) || end < len(src) && isImportPathByte(src[end]) {
+				continue
+			}
+			buf.Write(src[last:start])
+			buf.WriteString(m[string(src[start:end])])
+			last = end
+			changed = true
+		}
+		buf.Write(src[last:])
+		return changed, nil
+	})
+}
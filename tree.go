@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// treeNode is a file or directory of the destination tree printed by -dump-tree.
+type treeNode struct {
+	dir      bool
+	children map[string]*treeNode
+}
+
+// adds the file or directory at the slash-separated path rel below n, along with the
+// directories holding it
+func (n *treeNode) add(rel string, dir bool) {
+	for _, name := range strings.Split(rel, "/") {
+		child, ok := n.children[name]
+		if !ok {
+			child = &treeNode{children: make(map[string]*treeNode)}
+			n.children[name] = child
+		}
+		n.dir = true
+		n = child
+	}
+	n.dir = n.dir || dir
+}
+
+// removes the file or directory at the slash-separated path rel below n. A directory is
+// only removed if it is empty: a dry run copies nothing, so it sees directories as empty
+// that the files it would have copied keep.
+func (n *treeNode) remove(rel string) {
+	names := strings.Split(rel, "/")
+	for _, name := range names[:len(names)-1] {
+		if n = n.children[name]; n == nil {
+			return
+		}
+	}
+	if child, ok := n.children[names[len(names)-1]]; ok && len(child.children) == 0 {
+		delete(n.children, names[len(names)-1])
+	}
+}
+
+// prints the destination tree at root to stdout, one indented line per file and
+// directory. After a dry run, it is the tree as it would be: what is there already,
+// with the actions of the run applied.
+func dumpDestTree(root string) error {
+	tree := &treeNode{dir: true, children: make(map[string]*treeNode)}
+	err := fsys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			tree.add(filepath.ToSlash(rel), info.IsDir())
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if dry {
+		for _, action := range plan {
+			rel, err := filepath.Rel(root, action.Path)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			switch action.Action {
+			case "remove":
+				tree.remove(rel)
+			case "rename":
+				if src, err := filepath.Rel(root, action.Src); err == nil && !strings.HasPrefix(src, "..") {
+					tree.remove(filepath.ToSlash(src))
+				}
+				tree.add(rel, false)
+			default:
+				tree.add(rel, action.Action == "mkdir")
+			}
+		}
+	}
+
+	outputf("%s/\n", root)
+	tree.print(1)
+	return nil
+}
+
+// prints the children of n sorted by name, indented by depth, with directories ending in
+// a slash
+func (n *treeNode) print(depth int) {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := n.children[name]
+		if child.dir {
+			outputf("%s%s/\n", strings.Repeat("  ", depth), name)
+			child.print(depth + 1)
+		} else {
+			outputf("%s%s\n", strings.Repeat("  ", depth), name)
+		}
+	}
+}
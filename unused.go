@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// writes the import paths of the packages under root that no import refers to after
+// this run to stdout, one per line. Nothing is removed; that is what -mirror is for.
+func reportUnused(root string) error {
+	srcRoot := filepath.Join(gopath, "src")
+	used := make(map[string]bool)
+	for _, newPath := range copyRewrites() {
+		used[newPath] = true
+	}
+
+	var unused []string
+	err := fsys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		rel, err := filepath.Rel(srcRoot, dir)
+		if err != nil {
+			return err
+		}
+		importPath := filepath.ToSlash(rel)
+		mu.Lock()
+		_, copied := destDirs[dir]
+		mu.Unlock()
+		if !copied && !used[importPath] {
+			used[importPath] = true
+			unused = append(unused, importPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(unused)
+	for _, path := range unused {
+		outputf("%s\n", path)
+	}
+	return nil
+}